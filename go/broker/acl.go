@@ -0,0 +1,188 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type aclOp uint8
+
+const (
+	aclPub = aclOp(1 << iota)
+	aclSub
+)
+
+// TopicRange is an inclusive range of topics
+type TopicRange struct {
+	lo, hi uint16
+}
+
+func (tr TopicRange) contains(t uint16) bool {
+	return tr.lo <= t && t <= tr.hi
+}
+
+// parses "*", "n" or "lo-hi"
+func parseTopicRange(s string) (TopicRange, error) {
+	if s == "*" {
+		return TopicRange{0, 0xFFFF}, nil
+	}
+	los, his, isRange := strings.Cut(s, "-")
+	lo, err := strconv.ParseUint(los, 10, 16)
+	if err != nil {
+		return TopicRange{}, fmt.Errorf("topic range %q: %w", s, err)
+	}
+	hi := lo
+	if isRange {
+		hi, err = strconv.ParseUint(his, 10, 16)
+		if err != nil {
+			return TopicRange{}, fmt.Errorf("topic range %q: %w", s, err)
+		}
+	}
+	if lo > hi {
+		return TopicRange{}, fmt.Errorf("topic range %q: empty", s)
+	}
+	return TopicRange{uint16(lo), uint16(hi)}, nil
+}
+
+// ParseTopicRanges parses a comma-separated list of topic ranges
+func ParseTopicRanges(s string) ([]TopicRange, error) {
+	var trs []TopicRange
+	for _, part := range strings.Split(s, ",") {
+		tr, err := parseTopicRange(part)
+		if err != nil {
+			return nil, err
+		}
+		trs = append(trs, tr)
+	}
+	return trs, nil
+}
+
+type aclRule struct {
+	user   string // "*" matches everyone, including unidentified connections
+	allow  bool
+	ops    aclOp
+	topics []TopicRange
+}
+
+func (r aclRule) matches(user string, op aclOp, t uint16) bool {
+	if r.user != "*" && r.user != user {
+		return false
+	}
+	if r.ops&op == 0 {
+		return false
+	}
+	for _, tr := range r.topics {
+		if tr.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// acl is an ordered list of rules, the first one that matches decides.
+// If none matches, the operation is denied.
+type acl []aclRule
+
+func (a acl) allowed(user string, op aclOp, t uint16) bool {
+	for _, r := range a {
+		if r.matches(user, op, t) {
+			return r.allow
+		}
+	}
+	return false
+}
+
+// loadACL reads a file with one "user allow|deny pub|sub|pub,sub topics" rule per line,
+// e.g. "alice allow pub 0-99,200". Empty lines and lines starting with '#' are ignored.
+func loadACL(path string) (acl, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var a acl
+	sc := bufio.NewScanner(f)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r, err := parseACLRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineno, err)
+		}
+		a = append(a, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func parseACLRule(line string) (aclRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return aclRule{}, fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+	r := aclRule{user: fields[0]}
+
+	switch fields[1] {
+	case "allow":
+		r.allow = true
+	case "deny":
+		r.allow = false
+	default:
+		return aclRule{}, fmt.Errorf("expected allow or deny, got %q", fields[1])
+	}
+
+	for _, op := range strings.Split(fields[2], ",") {
+		switch op {
+		case "pub":
+			r.ops |= aclPub
+		case "sub":
+			r.ops |= aclSub
+		default:
+			return aclRule{}, fmt.Errorf("expected pub or sub, got %q", op)
+		}
+	}
+
+	topics, err := ParseTopicRanges(fields[3])
+	if err != nil {
+		return aclRule{}, err
+	}
+	r.topics = topics
+
+	return r, nil
+}
+
+// aclStore holds the current acl, which can be swapped while connections are checking against it
+type aclStore struct {
+	path string
+	p    atomic.Pointer[acl]
+}
+
+func makeACLStore(path string) (*aclStore, error) {
+	as := &aclStore{path: path}
+	if err := as.reload(); err != nil {
+		return nil, err
+	}
+	return as, nil
+}
+
+func (as *aclStore) reload() error {
+	a, err := loadACL(as.path)
+	if err != nil {
+		return err
+	}
+	as.p.Store(&a)
+	return nil
+}
+
+func (as *aclStore) allowed(user string, op aclOp, t uint16) bool {
+	return as.p.Load().allowed(user, op, t)
+}
@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	lines := []string{
+		"alice deny pub 50",
+		"alice allow pub,sub 0-99",
+		"bob allow sub *",
+		"* allow sub 1000-1999,3000",
+	}
+	var a acl
+	for _, line := range lines {
+		r, err := parseACLRule(line)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", line, err)
+		}
+		a = append(a, r)
+	}
+
+	cases := []struct {
+		user    string
+		op      aclOp
+		topic   uint16
+		allowed bool
+	}{
+		{"alice", aclPub, 10, true},
+		{"alice", aclSub, 50, true},
+		{"alice", aclPub, 50, false},
+		{"alice", aclPub, 100, false},
+		{"alice", aclSub, 1500, true},
+		{"bob", aclSub, 65535, true},
+		{"bob", aclPub, 10, false},
+		{"", aclSub, 3000, true},
+		{"", aclSub, 2000, false},
+		{"", aclPub, 1000, false},
+	}
+	for _, c := range cases {
+		if got := a.allowed(c.user, c.op, c.topic); got != c.allowed {
+			t.Errorf("allowed(%q, %d, %d) = %v, wanted %v", c.user, c.op, c.topic, got, c.allowed)
+		}
+	}
+
+	for _, line := range []string{
+		"alice allow pub",
+		"alice maybe pub 1",
+		"alice allow get 1",
+		"alice allow pub 10-5",
+		"alice allow pub 70000",
+	} {
+		if _, err := parseACLRule(line); err == nil {
+			t.Errorf("expected error parsing %q", line)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"cmp"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+type partitionTopics struct {
+	Partition int         `json:"partition"`
+	Topics    []topicInfo `json:"topics"`
+}
+
+type connectionInfo struct {
+	ID         uint64    `json:"id"`
+	Addr       string    `json:"addr"`
+	User       string    `json:"user,omitempty"`
+	Since      time.Time `json:"since"`
+	QueueDepth int       `json:"queueDepth"`
+	Topics     []uint16  `json:"topics"`
+}
+
+type statsInfo struct {
+	Connections int64            `json:"connections"`
+	Accepted    int64            `json:"accepted"`
+	Closed      int64            `json:"closed"`
+	RateLimited map[string]int64 `json:"rateLimited"`
+	Rejected    map[string]int64 `json:"rejected"`
+	Expired     int64            `json:"expired"`
+	Writes      int64            `json:"writes"`
+	MsgsIn      map[string]int64 `json:"msgsIn"`
+	MsgsOut     map[string]int64 `json:"msgsOut"`
+}
+
+func adminHandler(sv server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /topics", func(w http.ResponseWriter, r *http.Request) {
+		adminTopics(w, sv)
+	})
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		adminConnections(w, sv)
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		adminStats(w, sv)
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := writeMetrics(w, sv.stats, sv.limits); err != nil {
+			sv.log.Info("failed to write metrics", "proto", "admin", "err", err)
+		}
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, log *slog.Logger, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Info("failed to write response", "proto", "admin", "err", err)
+	}
+}
+
+func adminTopics(w http.ResponseWriter, sv server) {
+	infos := sv.info()
+	r := make([]partitionTopics, len(infos))
+	for i, pi := range infos {
+		slices.SortFunc(pi.topics, func(a, b topicInfo) int {
+			return int(a.Topic) - int(b.Topic)
+		})
+		r[i] = partitionTopics{i, pi.topics}
+	}
+	writeJSON(w, sv.log, r)
+}
+
+func adminConnections(w http.ResponseWriter, sv server) {
+	subs := make(map[uint64][]uint16)
+	for _, pi := range sv.info() {
+		for id, ts := range pi.subscriptions {
+			subs[id] = append(subs[id], ts...)
+		}
+	}
+	conns := sv.conns.list()
+	r := make([]connectionInfo, len(conns))
+	for i, ci := range conns {
+		ts := subs[ci.id]
+		slices.Sort(ts)
+		if ts == nil {
+			ts = []uint16{}
+		}
+		r[i] = connectionInfo{
+			ID:         ci.id,
+			Addr:       ci.addr,
+			User:       ci.user,
+			Since:      ci.since,
+			QueueDepth: ci.s.queued(),
+			Topics:     ts,
+		}
+	}
+	slices.SortFunc(r, func(a, b connectionInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	writeJSON(w, sv.log, r)
+}
+
+func adminStats(w http.ResponseWriter, sv server) {
+	st := sv.stats
+	writeJSON(w, sv.log, statsInfo{
+		Connections: st.connections(),
+		Accepted:    st.accepted.Load(),
+		Closed:      st.closed.Load(),
+		RateLimited: map[string]int64{
+			"connection": st.connLimited.Load(),
+			"topic":      st.topicLimited.Load(),
+		},
+		Rejected: sv.limits.rejections(),
+		Expired:  st.expirations(),
+		Writes:   st.writes.Load(),
+		MsgsIn:   countsByType(&st.msgsIn),
+		MsgsOut:  countsByType(&st.msgsOut),
+	})
+}
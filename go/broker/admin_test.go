@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAdminEndpoints(t *testing.T) {
+	sv, _ := startServer(t, ChannelEngine, nil)
+	hs := httptest.NewServer(adminHandler(sv))
+	t.Cleanup(hs.Close)
+
+	c := pipeTest(t, sv)
+	c.subscribe(1)
+	c.send(pub(1, "counted"))
+	c.expect(pub(1, "counted"))
+
+	request := func(method, path string, status int) string {
+		t.Helper()
+		req, err := http.NewRequest(method, hs.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: expected status %d, got %d", method, path, status, resp.StatusCode)
+		}
+		return string(body)
+	}
+
+	var st statsInfo
+	if err := json.Unmarshal([]byte(request("GET", "/stats", http.StatusOK)), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Connections != 1 || st.Accepted != 1 || st.MsgsIn["pub"] != 1 || st.MsgsOut["pub"] != 1 {
+		t.Errorf("unexpected stats after a publish: %+v", st)
+	}
+
+	var conns []connectionInfo
+	if err := json.Unmarshal([]byte(request("GET", "/connections", http.StatusOK)), &conns); err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 || !slices.Equal(conns[0].Topics, []uint16{1}) {
+		t.Errorf("unexpected connections: %+v", conns)
+	}
+
+	var parts []partitionTopics
+	if err := json.Unmarshal([]byte(request("GET", "/topics", http.StatusOK)), &parts); err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 {
+		t.Errorf("expected 2 partitions, got %d", len(parts))
+	}
+
+	metrics := request("GET", "/metrics", http.StatusOK)
+	for _, line := range []string{
+		"tcc_connections_accepted_total 1",
+		`tcc_messages_in_total{type="pub"} 1`,
+		`tcc_messages_out_total{type="pub"} 1`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("metrics don't have %q", line)
+		}
+	}
+
+	request("POST", "/stats", http.StatusMethodNotAllowed)
+	request("GET", "/unknown", http.StatusNotFound)
+}
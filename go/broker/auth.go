@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"bufio"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var errBadCredentials = errors.New("bad credentials")
+
+// Authenticator verifies the credentials carried by an auth message.
+// It must be safe for concurrent use.
+type Authenticator interface {
+	Authenticate(username, token string) error
+}
+
+type credential struct {
+	salt []byte
+	hash []byte
+}
+
+// fileAuthenticator reads credentials from a file with one "username salt hash" entry per line,
+// where salt and hash are hex encoded and hash is sha256(salt || token).
+// Empty lines and lines starting with '#' are ignored.
+type fileAuthenticator struct {
+	creds map[string]credential
+}
+
+var _ Authenticator = fileAuthenticator{}
+
+func loadFileAuthenticator(path string) (fileAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileAuthenticator{}, err
+	}
+	defer f.Close()
+
+	creds := make(map[string]credential)
+	sc := bufio.NewScanner(f)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fileAuthenticator{}, fmt.Errorf("%s:%d: expected 3 fields, got %d", path, lineno, len(fields))
+		}
+		salt, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return fileAuthenticator{}, fmt.Errorf("%s:%d: salt: %w", path, lineno, err)
+		}
+		hash, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return fileAuthenticator{}, fmt.Errorf("%s:%d: hash: %w", path, lineno, err)
+		}
+		if len(hash) != sha256.Size {
+			return fileAuthenticator{}, fmt.Errorf("%s:%d: hash has %d bytes, expected %d", path, lineno, len(hash), sha256.Size)
+		}
+		creds[fields[0]] = credential{salt, hash}
+	}
+	if err := sc.Err(); err != nil {
+		return fileAuthenticator{}, err
+	}
+	return fileAuthenticator{creds}, nil
+}
+
+func saltedHash(salt []byte, token string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(token))
+	return h.Sum(nil)
+}
+
+func (fa fileAuthenticator) Authenticate(username, token string) error {
+	c, ok := fa.creds[username]
+	if !ok {
+		return errBadCredentials
+	}
+	if subtle.ConstantTimeCompare(saltedHash(c.salt, token), c.hash) != 1 {
+		return errBadCredentials
+	}
+	return nil
+}
+
+// credentialStore holds the current credentials, which can be swapped like an aclStore's rules
+type credentialStore struct {
+	path string
+	p    atomic.Pointer[fileAuthenticator]
+}
+
+var _ Authenticator = (*credentialStore)(nil)
+
+func makeCredentialStore(path string) (*credentialStore, error) {
+	cs := &credentialStore{path: path}
+	if err := cs.reload(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *credentialStore) reload() error {
+	fa, err := loadFileAuthenticator(cs.path)
+	if err != nil {
+		return err
+	}
+	cs.p.Store(&fa)
+	return nil
+}
+
+func (cs *credentialStore) Authenticate(username, token string) error {
+	return cs.p.Load().Authenticate(username, token)
+}
+
+// CredentialLine makes a line for the credentials file, with a random salt
+func CredentialLine(username, token string) (string, error) {
+	if username == "" || strings.ContainsAny(username, ": \t") {
+		return "", fmt.Errorf("invalid username %q", username)
+	}
+	salt := make([]byte, 16)
+	if _, err := crand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := saltedHash(salt, token)
+	return fmt.Sprintf("%s %s %s", username, hex.EncodeToString(salt), hex.EncodeToString(hash)), nil
+}
@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds")
+	content := "# comment\n\n"
+	for _, c := range [][2]string{{"alice", "s3cret"}, {"bob", "hunter2"}} {
+		line, err := CredentialLine(c[0], c[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		content += line + "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fa, err := loadFileAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		username, token string
+		ok              bool
+	}{
+		{"alice", "s3cret", true},
+		{"bob", "hunter2", true},
+		{"alice", "hunter2", false},
+		{"bob", "", false},
+		{"carol", "s3cret", false},
+	}
+	for _, c := range cases {
+		err := fa.Authenticate(c.username, c.token)
+		if (err == nil) != c.ok {
+			t.Errorf("Authenticate(%q, %q) = %v, wanted ok=%v", c.username, c.token, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"tccgo/protocol"
+)
+
+// ErrServerClosed is returned by the Serve methods after Shutdown
+var ErrServerClosed = errors.New("broker: server closed")
+
+// Server is a publish/subscribe broker. Its listeners are started with the Serve methods,
+// and it can be used in-process with Publish and Subscribe.
+type Server struct {
+	sv     server
+	tn     topicNames
+	cancel context.CancelFunc
+	stop   chan zero
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]zero
+	admins    map[*http.Server]zero
+}
+
+type options struct {
+	nparts          int
+	auth            Authenticator
+	acl             *aclStore
+	rate            RateLimitConfig
+	limits          LimitsConfig
+	partition       partitionConfig
+	peers           []string
+	peerCredentials string
+	tn              topicNames
+	sessionGrace    time.Duration
+	sessionBuffer   int
+	keepalive       KeepaliveConfig
+	writes          WriteBatchConfig
+	engine          Engine
+	log             *slog.Logger
+}
+
+// Option configures a Server, see New
+type Option func(*options) error
+
+// WithPartitions sets the number of partitions, which defaults to the number of CPUs
+func WithPartitions(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid number of partitions %d", n)
+		}
+		o.nparts = n
+		return nil
+	}
+}
+
+// WithAuthenticator makes clients authenticate before anything else
+func WithAuthenticator(a Authenticator) Option {
+	return func(o *options) error {
+		o.auth = a
+		return nil
+	}
+}
+
+// WithCredentialsFile authenticates clients against a credentials file, see CredentialLine.
+// It can be reloaded with ReloadCredentials.
+func WithCredentialsFile(path string) Option {
+	return func(o *options) error {
+		cs, err := makeCredentialStore(path)
+		if err != nil {
+			return err
+		}
+		o.auth = cs
+		return nil
+	}
+}
+
+// WithACLFile checks publications and subscriptions against the rules in a file,
+// which can be reloaded with ReloadACL
+func WithACLFile(path string) Option {
+	return func(o *options) error {
+		as, err := makeACLStore(path)
+		if err != nil {
+			return err
+		}
+		o.acl = as
+		return nil
+	}
+}
+
+func WithRateLimit(c RateLimitConfig) Option {
+	return func(o *options) error {
+		if err := c.check(); err != nil {
+			return err
+		}
+		o.rate = c
+		return nil
+	}
+}
+
+func WithLimits(c LimitsConfig) Option {
+	return func(o *options) error {
+		o.limits = c
+		return nil
+	}
+}
+
+func WithGroupStrategy(gs GroupStrategy) Option {
+	return func(o *options) error {
+		o.partition.groupStrategy = gs
+		return nil
+	}
+}
+
+// WithPresence enables presence events for the topics in the ranges, see presence.go
+func WithPresence(trs []TopicRange) Option {
+	return func(o *options) error {
+		for _, tr := range trs {
+			if tr.hi&presenceBit != 0 {
+				return fmt.Errorf("presence topics must be below %d", presenceBit)
+			}
+		}
+		o.partition.presence = trs
+		return nil
+	}
+}
+
+// WithPeers links the server to other servers, see federation.go.
+// credentials are "username:token", or empty if the peers don't require authentication.
+func WithPeers(credentials string, addresses ...string) Option {
+	return func(o *options) error {
+		o.peers = append(o.peers, addresses...)
+		o.peerCredentials = credentials
+		return nil
+	}
+}
+
+// WithTopicNamesFile maps the topic names used by MQTT and RESP clients to topics
+func WithTopicNamesFile(path string) Option {
+	return func(o *options) error {
+		tn, err := loadTopicNames(path)
+		if err != nil {
+			return err
+		}
+		o.tn = tn
+		return nil
+	}
+}
+
+// WithSessions lets clients resume their subscriptions after reconnecting, see session.go.
+// A session is kept for grace after its connection is gone, buffering up to buffer publications.
+func WithSessions(grace time.Duration, buffer int) Option {
+	return func(o *options) error {
+		if grace <= 0 || buffer <= 0 {
+			return fmt.Errorf("invalid session grace period %v or buffer %d", grace, buffer)
+		}
+		o.sessionGrace = grace
+		o.sessionBuffer = buffer
+		return nil
+	}
+}
+
+// WithKeepalive sets how long the server waits before closing connections that stopped talking,
+// and whether it pings them, see KeepaliveConfig
+func WithKeepalive(c KeepaliveConfig) Option {
+	return func(o *options) error {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		o.keepalive = c
+		return nil
+	}
+}
+
+// WithWriteBatching sets how messages are batched when writing to connections, see WriteBatchConfig
+func WithWriteBatching(c WriteBatchConfig) Option {
+	return func(o *options) error {
+		if c.MaxBatch <= 0 || c.MaxDelay < 0 {
+			return fmt.Errorf("invalid write batching: batch %d, delay %v", c.MaxBatch, c.MaxDelay)
+		}
+		o.writes = c
+		return nil
+	}
+}
+
+// WithEngine chooses how the partitions are run, see Broker
+func WithEngine(e Engine) Option {
+	return func(o *options) error {
+		o.engine = e
+		return nil
+	}
+}
+
+// WithLogger sets where the server logs to, slog.Default() if not set. Connections log
+// with their id and remote address as attributes.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) error {
+		if l == nil {
+			return errors.New("nil logger")
+		}
+		o.log = l
+		return nil
+	}
+}
+
+func applyOptions(opts []Option) (options, error) {
+	o := options{nparts: numPartitions, keepalive: defaultKeepalive, writes: defaultWriteBatch}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return options{}, err
+		}
+	}
+	return o, nil
+}
+
+// CheckOptions returns the error New would return for the options, without making a server.
+// The files they name are read too.
+func CheckOptions(opts ...Option) error {
+	_, err := applyOptions(opts)
+	return err
+}
+
+// New makes a server and starts its partitions and peer links
+func New(opts ...Option) (*Server, error) {
+	o, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sv := makeServer(ctx, o.nparts, o.engine)
+	sv.auth = o.auth
+	sv.acl = o.acl
+	if o.rate.enabled() {
+		sv.rate = makeRateLimiter(o.rate)
+	}
+	sv.limits.setConfig(o.limits)
+	sv.keepalive = o.keepalive
+	sv.writes = o.writes
+	if o.log != nil {
+		sv.log = o.log
+	}
+	if o.sessionGrace > 0 {
+		sv.sessions = makeSessionTable(o.sessionGrace, o.sessionBuffer)
+	}
+	*sv.config = o.partition
+	sv.peers.addresses = o.peers
+	if u, _, ok := protocol.ParseAuthPayload(o.peerCredentials); ok {
+		sv.peers.user = u
+	}
+
+	s := &Server{
+		sv:        sv,
+		tn:        o.tn,
+		cancel:    cancel,
+		stop:      make(chan zero),
+		listeners: make(map[net.Listener]zero),
+		admins:    make(map[*http.Server]zero),
+	}
+	sv.start(s.stop)
+	for _, peer := range o.peers {
+		go dialPeer(peer, sv, o.peerCredentials)
+	}
+	return s, nil
+}
+
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = zero{}
+	return true
+}
+
+func (s *Server) serveWith(l net.Listener, f func() error) error {
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	err := f()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+	if s.closed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Serve accepts connections using the tcc protocol until the listener is closed
+func (s *Server) Serve(l net.Listener) error {
+	return s.serveWith(l, func() error { return serve(l, s.sv) })
+}
+
+// ServeMQTT accepts MQTT 3.1.1 connections, see mqtt.go
+func (s *Server) ServeMQTT(l net.Listener) error {
+	return s.serveWith(l, func() error { return serveMQTT(l, s.sv, s.tn) })
+}
+
+// ServeRESP accepts redis pub/sub connections, see resp.go
+func (s *Server) ServeRESP(l net.Listener) error {
+	return s.serveWith(l, func() error { return serveRESP(l, s.sv, s.tn) })
+}
+
+// ServeAdmin serves the HTTP admin API, see admin.go
+func (s *Server) ServeAdmin(l net.Listener) error {
+	hs := &http.Server{Handler: adminHandler(s.sv), ErrorLog: slog.NewLogLogger(s.sv.log.Handler(), slog.LevelWarn)}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.admins[hs] = zero{}
+	s.mu.Unlock()
+	if err := hs.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return ErrServerClosed
+}
+
+// ReloadACL reads the ACL file again, keeping the current rules if it fails
+func (s *Server) ReloadACL() error {
+	if s.sv.acl == nil {
+		return errors.New("no acl file")
+	}
+	return s.sv.acl.reload()
+}
+
+// ReloadCredentials reads the credentials file again, keeping the previous credentials if it fails.
+// Connections that already authenticated stay connected.
+func (s *Server) ReloadCredentials() error {
+	cs, ok := s.sv.auth.(*credentialStore)
+	if !ok {
+		return errors.New("no credentials file")
+	}
+	return cs.reload()
+}
+
+// SetLimits replaces the limits set with WithLimits. Connections and subscriptions
+// admitted before are kept, even if they're over the new limits.
+func (s *Server) SetLimits(c LimitsConfig) {
+	s.sv.limits.setConfig(c)
+}
+
+// Shutdown closes the listeners and every connection, and stops the partitions.
+// If ctx is done before the connections are gone, it returns the context's error.
+// The server can't be used after it's shut down.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) {
+			err = cerr
+		}
+	}
+	admins := s.admins
+	s.mu.Unlock()
+
+	for hs := range admins {
+		if herr := hs.Shutdown(ctx); herr != nil {
+			err = herr
+		}
+	}
+
+	s.cancel()
+	select {
+	case <-s.sv.conns.empty():
+		close(s.stop)
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish delivers a publication to the subscribers of topic, as if a client had published it
+func (s *Server) Publish(topic uint16, payload string) {
+	s.sv.publish(topic, payload)
+}
+
+// PublishExpiring is like Publish, but the publication is dropped if it's not delivered within ttl
+func (s *Server) PublishExpiring(topic uint16, payload string, ttl time.Duration) {
+	s.sv.publishExpiring(topic, payload, time.Now().Add(ttl))
+}
+
+// Subscription receives the publications on a topic in-process
+type Subscription struct {
+	C      <-chan protocol.Msg
+	cancel context.CancelFunc
+}
+
+// Subscribe subscribes to topic in-process. The subscription is like a connection:
+// publications are delivered to C in order, and the partition waits for each one to be received.
+func (s *Server) Subscribe(topic uint16) *Subscription {
+	sv := s.sv
+	ctx, cancel := context.WithCancel(sv.ctx)
+
+	mc := make(chan protocol.Msg, 1)
+	sub := sv.conns.add("in-process", ctx.Done(), mc)
+	sv.stats.accepted.Add(1)
+
+	context.AfterFunc(ctx, func() {
+		sv.disconnect(sub)
+		sv.conns.remove(sub.id)
+		sv.stats.closed.Add(1)
+	})
+
+	c := make(chan protocol.Msg)
+	go func() {
+		defer close(c)
+		for {
+			sub.backlog.Store(0)
+			select {
+			case <-ctx.Done():
+				return
+			case m := <-mc:
+				sub.backlog.Store(1)
+				if m.Type != protocol.PubMsg {
+					continue
+				}
+				if m.Expired(time.Now()) {
+					sv.stats.expired.Add(1)
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case c <- m:
+				}
+			}
+		}
+	}()
+
+	sv.subscribe(topic, sub, true)
+	return &Subscription{C: c, cancel: cancel}
+}
+
+// Unsubscribe ends the subscription and closes C
+func (sub *Subscription) Unsubscribe() {
+	sub.cancel()
+}
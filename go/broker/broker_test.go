@@ -0,0 +1,286 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"tccgo/protocol"
+)
+
+func TestServer(t *testing.T) {
+	for _, name := range []string{"channels", "locks"} {
+		t.Run(name, func(t *testing.T) {
+			e, _ := ParseEngine(name)
+			testServer(t, e)
+		})
+	}
+}
+
+func testServer(t *testing.T, e Engine) {
+	s, err := New(WithPartitions(2), WithEngine(e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	sub := s.Subscribe(7)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait for the subscription to be acknowledged, so the publication below is delivered
+	m := protocol.Msg{Type: protocol.SubMsg, Topic: 7}
+	if _, err := m.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadFrom(conn); err != nil || m.Type != protocol.SubMsg {
+		t.Fatalf("expected a sub ack, got %v, %v", m, err)
+	}
+
+	s.Publish(7, "hello")
+	select {
+	case m := <-sub.C:
+		if m.Payload != "hello" {
+			t.Errorf("in-process subscriber got %v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("in-process subscriber got nothing")
+	}
+	if _, err := m.ReadFrom(conn); err != nil || m.Payload != "hello" {
+		t.Errorf("connection got %v, %v", m, err)
+	}
+
+	sub.Unsubscribe()
+	if _, ok := <-sub.C; ok {
+		t.Error("expected C to be closed after unsubscribing")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+	if _, err := m.ReadFrom(conn); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+// exchange sends m and returns the answer
+func exchange(t *testing.T, conn net.Conn, m protocol.Msg) protocol.Msg {
+	t.Helper()
+	if _, err := m.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadFrom(conn); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSessionResumed(t *testing.T) {
+	s, err := New(WithPartitions(2), WithSessions(time.Minute, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := exchange(t, conn, protocol.Msg{Type: protocol.SessionMsg})
+	id, resumed, ok := protocol.ParseSessionPayload(m.Payload)
+	if !ok || resumed {
+		t.Fatalf("expected a new session, got %v", m)
+	}
+	exchange(t, conn, protocol.Msg{Type: protocol.SubMsg, Topic: 7})
+	conn.Close()
+
+	// the session outlives the connection
+	for len(s.sv.conns.list()) > 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Publish(7, "missed")
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m = exchange(t, conn, protocol.Msg{Type: protocol.SessionMsg, Payload: id})
+	if got, resumed, _ := protocol.ParseSessionPayload(m.Payload); got != id || !resumed {
+		t.Fatalf("expected session %s to be resumed, got %v", id, m)
+	}
+	if _, err := m.ReadFrom(conn); err != nil || m.Payload != "missed" {
+		t.Fatalf("expected the missed publication, got %v, %v", m, err)
+	}
+	s.Publish(7, "live")
+	if _, err := m.ReadFrom(conn); err != nil || m.Payload != "live" {
+		t.Fatalf("expected the subscription to be kept, got %v, %v", m, err)
+	}
+}
+
+func TestSessionExpiredMissed(t *testing.T) {
+	s, err := New(WithPartitions(2), WithSessions(time.Minute, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := exchange(t, conn, protocol.Msg{Type: protocol.SessionMsg})
+	id, _, _ := protocol.ParseSessionPayload(m.Payload)
+	exchange(t, conn, protocol.Msg{Type: protocol.SubMsg, Topic: 7})
+	conn.Close()
+	for len(s.sv.conns.list()) > 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the buffer is full once the second one is missed, but the stale one makes room
+	s.Publish(7, "first")
+	s.PublishExpiring(7, "stale", 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	s.Publish(7, "second")
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	exchange(t, conn, protocol.Msg{Type: protocol.SessionMsg, Payload: id})
+	for _, want := range []string{"first", "second"} {
+		if _, err := m.ReadFrom(conn); err != nil || m.Payload != want {
+			t.Fatalf("expected %q, got %v, %v", want, m, err)
+		}
+	}
+	if n := s.sv.stats.sessionDrops.Load(); n != 0 {
+		t.Errorf("dropped %d live publications", n)
+	}
+	if n := s.sv.stats.expired.Load(); n != 1 {
+		t.Errorf("counted %d expired publications, wanted 1", n)
+	}
+}
+
+func TestKeepalivePing(t *testing.T) {
+	s, err := New(WithPartitions(2), WithKeepalive(KeepaliveConfig{Idle: time.Minute, Ping: 50 * time.Millisecond, Pong: 50 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	m := protocol.Msg{Type: protocol.KeepaliveMsg}
+	if _, err := m.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadFrom(conn); err != nil || m.Payload != "60000 50" {
+		t.Fatalf("expected the keepalive settings, got %v, %v", m, err)
+	}
+
+	// answered pings keep the connection open
+	for range 3 {
+		if _, err := m.ReadFrom(conn); err != nil || m.Type != protocol.PingMsg {
+			t.Fatalf("expected a ping, got %v, %v", m, err)
+		}
+		if _, err := m.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// and an unanswered one closes it
+	start := time.Now()
+	if _, err := m.ReadFrom(conn); err != nil || m.Type != protocol.PingMsg {
+		t.Fatalf("expected a ping, got %v, %v", m, err)
+	}
+	if _, err := m.ReadFrom(conn); err == nil {
+		t.Fatalf("expected the connection to be closed, got %v", m)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("took %v to close the connection", d)
+	}
+}
+
+// BenchmarkFanout delivers a publication to every subscriber of a topic, each with a writer
+// that encodes what it receives like writeToConn does
+func BenchmarkFanout(b *testing.B) {
+	for _, e := range []string{"channels", "locks"} {
+		for _, n := range []int{1, 100, 1920} {
+			b.Run(fmt.Sprintf("engine=%s/subscribers=%d", e, n), func(b *testing.B) {
+				engine, _ := ParseEngine(e)
+				sv := makeServer(context.Background(), 1, engine)
+				stop := make(chan zero)
+				sv.start(stop)
+				done := make(chan zero)
+				wg := new(sync.WaitGroup)
+				for i := range n {
+					mc := make(chan protocol.Msg, 1)
+					sv.subscribe(1, makeSubscriber(uint64(i), done, mc), true)
+					<-mc // the ack
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						buf := new(bytes.Buffer)
+						for {
+							select {
+							case <-done:
+								return
+							case m := <-mc:
+								buf.Reset()
+								m.WriteTo(buf)
+								buf.WriteTo(io.Discard)
+							}
+						}
+					}()
+				}
+
+				p := "pub 12 msg 3456 and some more bytes to make it realistic"
+				b.ResetTimer()
+				for range b.N {
+					sv.publishCounted(1, p)
+				}
+				b.StopTimer()
+				close(done)
+				wg.Wait()
+				close(stop)
+			})
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package broker
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"tccgo/protocol"
+)
+
+// Broker keeps the subscriptions of a server and delivers its publications. Topics are split among
+// partitions (see partitionIndex) and every engine uses the same serverPartition bookkeeping;
+// they differ in how access to it is serialized. Unsubscribing is a subscriptionRequest too.
+type Broker interface {
+	start(stop <-chan zero)
+	subscribe(sx subscriptionRequest)
+	publish(px publication)
+	disconnect(s subscriber)
+	watch(s subscriber) // starts telling a peer about the topics with local subscribers
+	members(t uint16, s subscriber)
+	info() []partitionInfo
+}
+
+// Engine chooses the Broker implementation
+type Engine uint8
+
+const (
+	// each partition is owned by a goroutine, which is sent requests through channels
+	ChannelEngine = Engine(iota)
+	// partitions are behind a RWMutex, and publishers deliver holding it for reading
+	LockEngine
+)
+
+// ParseEngine parses "channels" or "locks"
+func ParseEngine(s string) (Engine, error) {
+	switch s {
+	case "channels":
+		return ChannelEngine, nil
+	case "locks":
+		return LockEngine, nil
+	default:
+		return 0, fmt.Errorf("unknown engine %q", s)
+	}
+}
+
+func makeEngine(e Engine, parts []serverPartition, stats *serverStats) Broker {
+	if e == LockEngine {
+		return makeLockEngine(parts, stats)
+	}
+	return makeChannelEngine(parts, stats)
+}
+
+type channelEngine struct {
+	parts []serverPartition
+	chans []serverPartitionChannels
+	stats *serverStats
+}
+
+func makeChannelEngine(parts []serverPartition, stats *serverStats) channelEngine {
+	chans := make([]serverPartitionChannels, len(parts))
+	for i := range chans {
+		chans[i] = makeServerPartitionChannels()
+	}
+	return channelEngine{parts, chans, stats}
+}
+
+func (ce channelEngine) start(stop <-chan zero) {
+	for i := range ce.parts {
+		go ce.chans[i].main(ce.parts[i], stop)
+	}
+}
+
+func (ce channelEngine) subscribe(sx subscriptionRequest) {
+	i := partitionIndex(sx.topic, len(ce.chans))
+	start := time.Now()
+	ce.chans[i].subscribe <- sx
+	ce.stats.parts[i].chanWait.since(start)
+}
+
+func (ce channelEngine) publish(px publication) {
+	i := partitionIndex(px.topic, len(ce.chans))
+	start := time.Now()
+	ce.chans[i].publish <- px
+	ce.stats.parts[i].chanWait.since(start)
+}
+
+func (ce channelEngine) disconnect(s subscriber) {
+	for i, spc := range ce.chans {
+		start := time.Now()
+		spc.disconnect <- s
+		ce.stats.parts[i].chanWait.since(start)
+	}
+}
+
+func (ce channelEngine) watch(s subscriber) {
+	for _, spc := range ce.chans {
+		spc.peer <- s
+	}
+}
+
+func (ce channelEngine) members(t uint16, s subscriber) {
+	ce.chans[partitionIndex(t, len(ce.chans))].members <- membersRequest{t, s}
+}
+
+func (ce channelEngine) info() []partitionInfo {
+	rc := make(chan partitionInfo)
+	r := make([]partitionInfo, len(ce.chans))
+	for i, spc := range ce.chans {
+		spc.query <- rc
+		r[i] = <-rc
+	}
+	return r
+}
+
+// lockEngine changes the partitions with their lock held for writing, and delivers publications
+// from the publishing goroutine with the lock held for reading, so publications to the same
+// partition are delivered concurrently, and an unsubscription waits for the deliveries that
+// may include it.
+type lockEngine struct {
+	shards []*lockShard
+	stats  *serverStats
+	stop   *<-chan zero // set by start, the results of commands are dropped once it's closed
+}
+
+type lockShard struct {
+	mu      sync.RWMutex
+	sp      serverPartition
+	targets map[uint16][]target // each topic's subscribers, rebuilt when they change
+}
+
+type target struct {
+	s subscriber
+	f *contentFilter
+}
+
+func makeLockEngine(parts []serverPartition, stats *serverStats) lockEngine {
+	shards := make([]*lockShard, len(parts))
+	for i, sp := range parts {
+		shards[i] = &lockShard{sp: sp, targets: make(map[uint16][]target)}
+	}
+	return lockEngine{shards, stats, new(<-chan zero)}
+}
+
+// nothing runs in the background, publications are delivered by whoever publishes them
+func (le lockEngine) start(stop <-chan zero) {
+	*le.stop = stop
+}
+
+// lock counts the time waited for the lock as the channel engine counts the time waited for a partition
+func (le lockEngine) lock(i int) *lockShard {
+	sh := le.shards[i]
+	start := time.Now()
+	sh.mu.Lock()
+	le.stats.parts[i].chanWait.since(start)
+	return sh
+}
+
+func (sh *lockShard) refresh(t uint16) {
+	ss := sh.sp.subscribers[t]
+	if len(ss) == 0 {
+		delete(sh.targets, t)
+		return
+	}
+	fs := sh.sp.filters[t]
+	ts := make([]target, 0, len(ss))
+	for s := range ss {
+		ts = append(ts, target{s, fs[s]})
+	}
+	sh.targets[t] = ts
+}
+
+// subscribe sends the ack before releasing the lock, so no publication reaches the subscriber
+// ahead of it. The channel engine's partition waits for the ack the same way.
+func (le lockEngine) subscribe(sx subscriptionRequest) {
+	sh := le.lock(partitionIndex(sx.topic, len(le.shards)))
+	defer sh.mu.Unlock()
+	sh.sp.handleSubscription(sx)
+	sh.refresh(sx.topic)
+}
+
+func (le lockEngine) publish(px publication) {
+	i := partitionIndex(px.topic, len(le.shards))
+	sh, st := le.shards[i], le.stats.parts[i]
+	switch {
+	case px.expired(time.Now()):
+		st.expired.Add(1)
+		px.done(0)
+	case px.kind == protocol.RequestMsg:
+		px.done(sh.deliver(protocol.Msg{Type: protocol.RequestMsg, Topic: px.topic, Payload: px.payload}, true, px.responders))
+	case px.isCommand():
+		px.done(0)
+		stop := *le.stop
+		go func() {
+			result := px.runCommand(st)
+			select {
+			case <-stop:
+			default:
+				le.publish(result)
+			}
+		}()
+	default:
+		m := protocol.Msg{Type: protocol.PubMsg, Topic: px.topic, Payload: px.payload, Deadline: px.deadline}
+		px.done(sh.deliver(m, px.fromPeer, nil))
+	}
+}
+
+// deliver is like serverPartition.deliver, but holds the lock for writing only if the topic has groups,
+// since picking a member changes the group
+func (sh *lockShard) deliver(m protocol.Msg, skipPeers bool, rs *responderSet) int {
+	sh.mu.RLock()
+	if len(sh.sp.groups[m.Topic]) > 0 {
+		sh.mu.RUnlock()
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+		return sh.sp.deliver(m, skipPeers, rs)
+	}
+	defer sh.mu.RUnlock()
+
+	ts := sh.targets[m.Topic]
+	if len(ts) > 0 {
+		m = m.Encoded()
+	}
+	n := 0
+	for _, tg := range ts {
+		if deliverTo(tg.s, tg.f, m, skipPeers, rs) {
+			n++
+		}
+	}
+	sh.sp.stats.fanout.observe(float64(n))
+	return n
+}
+
+func (le lockEngine) disconnect(s subscriber) {
+	for i := range le.shards {
+		sh := le.lock(i)
+		ts := slices.Collect(maps.Keys(sh.sp.topics[s]))
+		sh.sp.handleDisconnect(s)
+		for _, t := range ts {
+			sh.refresh(t)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+func (le lockEngine) watch(s subscriber) {
+	for i := range le.shards {
+		sh := le.lock(i)
+		sh.sp.handlePeer(s)
+		sh.mu.Unlock()
+	}
+}
+
+func (le lockEngine) members(t uint16, s subscriber) {
+	sh := le.shards[partitionIndex(t, len(le.shards))]
+	sh.mu.RLock()
+	m := sh.sp.members(t)
+	sh.mu.RUnlock()
+	s.send(m)
+}
+
+func (le lockEngine) info() []partitionInfo {
+	r := make([]partitionInfo, len(le.shards))
+	for i, sh := range le.shards {
+		sh.mu.RLock()
+		r[i] = sh.sp.info()
+		sh.mu.RUnlock()
+	}
+	return r
+}
@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"tccgo/protocol"
+)
+
+// Servers can be linked so that publications reach subscribers of other servers.
+// A link is a regular connection, started by either side with a peer message carrying
+// its node id, which the other side answers with its own. After that both sides are
+// symmetric: each sends sub and unsub messages for the topics it has local subscribers
+// for, and forwards publications to the peers subscribed to them.
+// Publications received from a peer are only delivered locally, so servers
+// must be linked as a full mesh for every publication to reach every server.
+// A server only accepts links from the addresses of its own peers, authenticated
+// with its own peer credentials if it requires authentication, so every server of the mesh
+// lists the others and they share the credentials.
+
+const (
+	peerRetryInterval = 5 * time.Second
+	peerPingInterval  = 30 * time.Second
+)
+
+func makeNodeID() string {
+	bs := make([]byte, 8)
+	if _, err := crand.Read(bs); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bs)
+}
+
+// peerTable keeps at most one link to each node
+type peerTable struct {
+	addresses []string // of the configured peers
+	user      string   // of the peer credentials
+
+	mu    sync.Mutex
+	nodes map[string]zero
+}
+
+func makePeerTable() *peerTable {
+	return &peerTable{
+		nodes: make(map[string]zero),
+	}
+}
+
+func (pt *peerTable) add(node string) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if _, ok := pt.nodes[node]; ok {
+		return false
+	}
+	pt.nodes[node] = zero{}
+	return true
+}
+
+func (pt *peerTable) remove(node string) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	delete(pt.nodes, node)
+}
+
+// accepts reports whether a connection from addr may link as a peer, user is who it authenticated as
+// if authentication is required
+func (pt *peerTable) accepts(ctx context.Context, addr net.Addr, user string, auth bool) bool {
+	if auth && (pt.user == "" || user != pt.user) {
+		return false
+	}
+	ip := remoteIP(addr)
+	for _, a := range pt.addresses {
+		host, _, err := net.SplitHostPort(a)
+		if err != nil {
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			continue
+		}
+		for _, peerIP := range ips {
+			if peerIP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type peerLink struct {
+	node   string // empty if not a link to another server
+	dialed bool   // whether this server started the link
+}
+
+var (
+	errAlreadyLinked = errors.New("already linked")
+	errPeerRefused   = errors.New("not a configured peer")
+)
+
+// dialPeer keeps a link to the server at address, reconnecting whenever it's lost,
+// until the server shuts down
+func dialPeer(address string, sv server, credentials string) {
+	for {
+		if err := linkPeer(address, sv, credentials); err != nil && err != errAlreadyLinked && sv.ctx.Err() == nil {
+			sv.log.Warn("failed to link to peer", "address", address, "err", err)
+		}
+		select {
+		case <-sv.ctx.Done():
+			return
+		case <-time.After(peerRetryInterval):
+		}
+	}
+}
+
+func linkPeer(address string, sv server, credentials string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(sv.ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+
+	node, err := peerHandshake(conn, sv, credentials)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !sv.peers.add(node) {
+		conn.Close()
+		return errAlreadyLinked
+	}
+	sv.log.Info("linked to peer", "node", node, "address", address)
+
+	done := make(chan zero)
+	defer close(done)
+	go func() {
+		// often enough for the other side's idle timeout, assuming it's configured like this one
+		tick := time.NewTicker(min(peerPingInterval, sv.keepalive.Idle/2))
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+				m := protocol.Msg{Type: protocol.PingMsg}
+				if _, err := m.WriteTo(conn); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	serveConn(conn, sv, peerLink{node: node, dialed: true})
+	return nil
+}
+
+func peerHandshake(conn net.Conn, sv server, credentials string) (string, error) {
+	if err := conn.SetDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return "", err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	if credentials != "" {
+		m := protocol.Msg{Type: protocol.AuthMsg, Payload: credentials}
+		if _, err := m.WriteTo(conn); err != nil {
+			return "", err
+		}
+		if _, err := m.ReadFrom(conn); err != nil {
+			return "", err
+		}
+		if m.Type != protocol.AuthMsg {
+			return "", fmt.Errorf("failed to authenticate: %v", m)
+		}
+	}
+
+	m := protocol.Msg{Type: protocol.PeerMsg, Payload: sv.node}
+	if _, err := m.WriteTo(conn); err != nil {
+		return "", err
+	}
+	if _, err := m.ReadFrom(conn); err != nil {
+		return "", err
+	}
+	if m.Type != protocol.PeerMsg {
+		if m.Type == protocol.ErrMsg && m.Payload == errAlreadyLinked.Error() {
+			return "", errAlreadyLinked
+		}
+		return "", fmt.Errorf("unexpected reply: %v", m)
+	}
+	return m.Payload, nil
+}
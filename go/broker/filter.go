@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A subscription can carry a filter in the payload of the sub message,
+// and then only receives the publications whose payload matches it:
+//
+//	prefix <text>
+//	contains <text>
+//	regexp <expression>
+//	header <name>=<value>
+//
+// Headers are "name: value" lines at the start of the payload, ending at the first empty line.
+// Filters are compiled once, when the subscription is made, and kept by the partition.
+
+type filterKind uint8
+
+const (
+	filterPrefix = filterKind(iota)
+	filterContains
+	filterRegexp
+	filterHeader
+)
+
+type contentFilter struct {
+	kind filterKind
+	text string // the prefix, substring or header value
+	name string // header name
+	re   *regexp.Regexp
+}
+
+// parseFilter returns nil for an empty filter, which matches everything
+func parseFilter(s string) (*contentFilter, error) {
+	if s == "" {
+		return nil, nil
+	}
+	kind, arg, _ := strings.Cut(s, " ")
+	f := new(contentFilter)
+	switch kind {
+	case "prefix":
+		f.kind, f.text = filterPrefix, arg
+	case "contains":
+		f.kind, f.text = filterContains, arg
+	case "regexp":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("filter: %w", err)
+		}
+		f.kind, f.re = filterRegexp, re
+	case "header":
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("filter: expected header name=value, got %q", arg)
+		}
+		f.kind, f.name, f.text = filterHeader, name, value
+	default:
+		return nil, fmt.Errorf("filter: unknown kind %q", kind)
+	}
+	return f, nil
+}
+
+func (f *contentFilter) match(payload string) bool {
+	if f == nil {
+		return true
+	}
+	switch f.kind {
+	case filterPrefix:
+		return strings.HasPrefix(payload, f.text)
+	case filterContains:
+		return strings.Contains(payload, f.text)
+	case filterRegexp:
+		return f.re.MatchString(payload)
+	case filterHeader:
+		v, ok := payloadHeader(payload, f.name)
+		return ok && v == f.text
+	default:
+		return false
+	}
+}
+
+// payloadHeader finds the value of a header, names are case-insensitive
+func payloadHeader(payload string, name string) (string, bool) {
+	sc := bufio.NewScanner(strings.NewReader(payload))
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			break
+		}
+		if strings.EqualFold(strings.TrimSpace(k), name) {
+			return strings.TrimSpace(v), true
+		}
+	}
+	return "", false
+}
+
+func (sp serverPartition) setFilter(t uint16, s subscriber, f *contentFilter) {
+	fs, ok := sp.filters[t]
+	if f == nil {
+		if ok {
+			delete(fs, s)
+			if len(fs) == 0 {
+				delete(sp.filters, t)
+			}
+		}
+		return
+	}
+	if !ok {
+		fs = make(map[subscriber]*contentFilter)
+		sp.filters[t] = fs
+	}
+	fs[s] = f
+}
@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	cases := []struct {
+		filter  string
+		payload string
+		match   bool
+	}{
+		{"", "anything", true},
+		{"prefix temp", "temp=20", true},
+		{"prefix temp", "hum=20", false},
+		{"contains =2", "temp=20", true},
+		{"regexp ^temp=[0-9]+$", "temp=20", true},
+		{"regexp ^temp=[0-9]+$", "temp=hot", false},
+		{"header kind=alert", "Kind: alert\nsource: a\n\nbody", true},
+		{"header kind=alert", "kind: info\n\nbody", false},
+		{"header kind=alert", "body\n\nkind: alert", false},
+	}
+	for _, c := range cases {
+		f, err := parseFilter(c.filter)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", c.filter, err)
+		}
+		if got := f.match(c.payload); got != c.match {
+			t.Errorf("%q on %q: got %v, wanted %v", c.filter, c.payload, got, c.match)
+		}
+	}
+
+	for _, s := range []string{"suffix a", "regexp (", "header nameonly"} {
+		if _, err := parseFilter(s); err == nil {
+			t.Errorf("parsing %q: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"tccgo/protocol"
+)
+
+type zero = struct{}
+
+const (
+	writeTimeout = 5 * time.Second
+)
+
+var (
+	numPartitions = runtime.NumCPU()
+)
+
+func serve(l net.Listener, sv server) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			sv.log.Error("failed to accept connection", "err", err)
+			continue
+		}
+		go handleConn(conn, sv)
+	}
+}
+
+func handleConn(conn net.Conn, sv server) {
+	ip := remoteIP(conn.RemoteAddr())
+	if k := sv.limits.acquire(ip); k != limitNone {
+		log := sv.log.With("remote", conn.RemoteAddr().String())
+		log.Info("connection rejected", "reason", k.message())
+		closeWithError(conn, log, sv.stats, errorMsg(0, k.message()))
+		if err := conn.Close(); err != nil {
+			log.Warn("failed to close connection", "err", err)
+		}
+		return
+	}
+	defer sv.limits.release(ip)
+
+	serveConn(conn, sv, peerLink{})
+}
+
+func serveConn(conn net.Conn, sv server, link peerLink) {
+	ctx, cancel := context.WithCancel(sv.ctx)
+	defer cancel()
+
+	mc := make(chan protocol.Msg, 1)
+	s := sv.conns.add(conn.RemoteAddr().String(), ctx.Done(), mc)
+	id := s.id
+	log := sv.log.With("conn", id, "remote", conn.RemoteAddr().String())
+	log.Debug("connection opened")
+	sv.stats.accepted.Add(1)
+	s.peer = link.node != ""
+	var sess atomic.Pointer[session] // once set, s is the session's subscriber
+
+	context.AfterFunc(ctx, func() {
+		if err := conn.Close(); err != nil {
+			log.Warn("failed to close connection", "err", err)
+		}
+		if ss := sess.Load(); ss != nil {
+			ss.detach(ctx.Done(), sv.sessions.grace)
+		} else {
+			sv.disconnect(s)
+		}
+		sv.conns.remove(id)
+		if link.node != "" {
+			sv.peers.remove(link.node)
+		}
+		sv.stats.closed.Add(1)
+		log.Debug("connection closed")
+	})
+
+	// the writer is stopped before an error is written directly, so their writes don't interleave
+	wctx, stopWriter := context.WithCancel(ctx)
+	written := make(chan zero)
+	backlog := s.backlog // s changes if it opens a session
+	go func() {
+		defer close(written)
+		writeToConn(wctx.Done(), mc, backlog, conn, log, sv.stats, sv.writes)
+	}()
+	closeWith := func(m protocol.Msg) {
+		stopWriter()
+		// a writer stuck on a write gives up by then too
+		if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err == nil {
+			<-written
+		}
+		closeWithError(conn, log, sv.stats, m)
+	}
+
+	if s.peer {
+		sv.watch(s)
+	}
+
+	authenticated := sv.auth == nil || s.peer
+	first := true
+	username := ""
+
+	var limit connLimit
+	if sv.rate != nil {
+		limit = sv.rate.forConn()
+	}
+
+	ka := makeKeepalive(sv.keepalive, time.Now())
+
+	for {
+		if s.isDone() {
+			return
+		}
+
+		m := protocol.Msg{}
+		if err := conn.SetReadDeadline(ka.deadline()); err != nil {
+			log.Warn("failed to set read deadline", "err", err)
+			return
+		}
+		if n, err := m.ReadFrom(conn); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// peers ping each other on their own, see dialPeer
+				if n == 0 && !s.peer && ka.timedOut(time.Now()) {
+					if !pingConn(conn, log, sv.stats) {
+						return
+					}
+					continue
+				}
+				sv.stats.readTimeouts.Add(1)
+			}
+			if err != io.EOF {
+				log.Info("failed to read message", "err", err)
+			}
+			return
+		}
+		pong := ka.received(time.Now())
+		sv.stats.received(m.Type)
+		if !authenticated {
+			u, ok := authenticate(m, sv, id, log)
+			if !ok {
+				closeWith(errorMsg(0, "authentication failed"))
+				return
+			}
+			authenticated = true
+			username = u
+			s.send(protocol.Msg{Type: protocol.AuthMsg})
+			continue
+		}
+		if s.peer {
+			if !handlePeerMsg(conn, log, m, s, sv, link.dialed) {
+				return
+			}
+			continue
+		}
+		if m.Type == protocol.PeerMsg {
+			// only as the first message, before the connection subscribes as a regular client
+			if !first || !sv.peers.accepts(ctx, conn.RemoteAddr(), username, sv.auth != nil) {
+				log.Warn("refused peer link", "node", m.Payload, "user", username)
+				closeWith(errorMsg(0, errPeerRefused.Error()))
+				return
+			}
+			if m.Payload == sv.node || !sv.peers.add(m.Payload) {
+				closeWith(errorMsg(0, errAlreadyLinked.Error()))
+				return
+			}
+			link.node = m.Payload
+			s.peer = true
+			log.Info("linked to peer", "node", link.node)
+			s.send(protocol.Msg{Type: protocol.PeerMsg, Payload: sv.node})
+			sv.watch(s)
+			continue
+		}
+		if m.Type == protocol.SessionMsg {
+			// also only as the first message, the subscriptions made before would be lost
+			if sv.sessions == nil {
+				s.send(errorMsg(0, "sessions are disabled"))
+			} else if !first {
+				s.send(errorMsg(0, "session must be the first message"))
+			} else {
+				ss, resumed := openSession(sv, m.Payload, username, &sess, mc, ctx.Done(), cancel)
+				log.Debug("session opened", "session", ss.id, "resumed", resumed)
+				s = ss.s
+			}
+			first = false
+			continue
+		}
+		if m.Type == protocol.KeepaliveMsg {
+			s.send(protocol.Msg{Type: protocol.KeepaliveMsg, Payload: protocol.KeepalivePayload(sv.keepalive.Idle, sv.keepalive.Ping)})
+			continue
+		}
+		first = false
+		switch m.Type {
+		case protocol.PingMsg:
+			// the answer to a ping from the server isn't echoed, or they'd bounce back and forth
+			if !pong && !pingConn(conn, log, sv.stats) {
+				return
+			}
+		case protocol.PubMsg, protocol.TTLPubMsg, protocol.RequestMsg:
+			// requests fan out like publications, so they're checked and limited the same way
+			var deadline time.Time
+			if m.Type == protocol.TTLPubMsg {
+				ttl, p, ok := protocol.ParseTTLPayload(m.Payload)
+				if !ok {
+					s.send(errorMsg(m.Topic, "malformed ttl"))
+					continue
+				}
+				deadline, m.Payload = time.Now().Add(ttl), p
+			}
+			if sv.config.isPresenceTopic(m.Topic) || (sv.acl != nil && !sv.acl.allowed(username, aclPub, m.Topic)) {
+				s.send(refusal(m, "publish denied"))
+				continue
+			}
+			if sv.rate != nil && limit.check(m.Topic, sv.stats) != noViolation {
+				switch sv.rate.config.Action {
+				case RateDrop:
+					s.send(refusal(m, "rate limited"))
+					continue
+				case RateDisconnect:
+					log.Info("disconnecting for exceeding the rate limit", "topic", m.Topic)
+					closeWith(refusal(m, "rate limited"))
+					return
+				}
+			}
+			if m.Type == protocol.RequestMsg {
+				sv.request(s, m.Topic, m.Payload)
+				continue
+			}
+			sv.publishExpiring(m.Topic, m.Payload, deadline)
+		case protocol.SubMsg:
+			if sv.acl != nil && !sv.acl.allowed(username, aclSub, m.Topic) {
+				s.send(errorMsg(m.Topic, "subscribe denied"))
+				continue
+			}
+			f, err := parseFilter(m.Payload)
+			if err != nil {
+				s.send(errorMsg(m.Topic, err.Error()))
+				continue
+			}
+			sv.subscribeFiltered(m.Topic, s, f)
+		case protocol.UnsubMsg:
+			sv.subscribe(m.Topic, s, false)
+		case protocol.GroupSubMsg:
+			if m.Payload == "" {
+				s.send(errorMsg(m.Topic, "missing group name"))
+				continue
+			}
+			if sv.acl != nil && !sv.acl.allowed(username, aclSub, m.Topic) {
+				s.send(errorMsg(m.Topic, "subscribe denied"))
+				continue
+			}
+			sv.subscribeGroup(m.Topic, m.Payload, s, true)
+		case protocol.GroupUnsubMsg:
+			sv.subscribeGroup(m.Topic, m.Payload, s, false)
+		case protocol.ReplyMsg:
+			sv.reply(s, m.Payload)
+		case protocol.MembersMsg:
+			if sv.acl != nil && !sv.acl.allowed(username, aclSub, presenceTopic(m.Topic)) {
+				s.send(errorMsg(m.Topic, "subscribe denied"))
+				continue
+			}
+			sv.members(m.Topic, s)
+		case protocol.AuthMsg:
+			if sv.auth != nil {
+				s.send(errorMsg(0, "already authenticated"))
+			} else {
+				// auth is disabled, so the name can't be checked and the acl treats the connection
+				// as anonymous, or anyone could claim to be a privileged user
+				s.send(protocol.Msg{Type: protocol.AuthMsg})
+			}
+		}
+	}
+}
+
+// openSession resumes or starts a session and attaches the connection to it.
+// The session is stored before it's attached, since attaching another connection kicks this one.
+func openSession(sv server, id string, user string, sess *atomic.Pointer[session], mc chan<- protocol.Msg, done <-chan zero, kick context.CancelFunc) (*session, bool) {
+	for {
+		ss, resumed := sv.sessions.open(id, user, sv)
+		sess.Store(ss)
+		state := "new"
+		if resumed {
+			state = "resumed"
+		}
+		if ss.attach(mc, done, kick, protocol.Msg{Type: protocol.SessionMsg, Payload: ss.id + " " + state}, sv.stats) {
+			if resumed {
+				sv.stats.resumed.Add(1)
+			}
+			return ss, resumed
+		}
+	}
+}
+
+func handlePeerMsg(conn net.Conn, log *slog.Logger, m protocol.Msg, s subscriber, sv server, dialed bool) bool {
+	switch m.Type {
+	case protocol.PingMsg:
+		// only the side that accepted the link answers pings, or they'd bounce back and forth
+		if !dialed && !pingConn(conn, log, sv.stats) {
+			return false
+		}
+	case protocol.PubMsg:
+		sv.relay(m.Topic, m.Payload, time.Time{})
+	case protocol.TTLPubMsg:
+		if ttl, p, ok := protocol.ParseTTLPayload(m.Payload); ok {
+			sv.relay(m.Topic, p, time.Now().Add(ttl))
+		}
+	case protocol.SubMsg:
+		sv.subscribe(m.Topic, s, true)
+	case protocol.UnsubMsg:
+		sv.subscribe(m.Topic, s, false)
+	}
+	return true
+}
+
+func authenticate(m protocol.Msg, sv server, id uint64, log *slog.Logger) (string, bool) {
+	if m.Type != protocol.AuthMsg {
+		return "", false
+	}
+	username, token, ok := protocol.ParseAuthPayload(m.Payload)
+	if !ok {
+		return "", false
+	}
+	if err := sv.auth.Authenticate(username, token); err != nil {
+		if err != errBadCredentials {
+			log.Warn("failed to authenticate", "user", username, "err", err)
+		}
+		return "", false
+	}
+	log.Debug("authenticated", "user", username)
+	sv.conns.identify(id, username)
+	return username, true
+}
+
+func pingConn(conn net.Conn, log *slog.Logger, st *serverStats) bool {
+	m := protocol.Msg{Type: protocol.PingMsg}
+	if _, err := m.WriteTo(conn); err != nil {
+		log.Info("failed to ping", "err", err)
+		return false
+	}
+	st.sent(protocol.PingMsg)
+	return true
+}
+
+func errorMsg(topic uint16, text string) protocol.Msg {
+	return protocol.Msg{Type: protocol.ErrMsg, Topic: topic, Payload: text}
+}
+
+// refusal is the error about a publication or a request that wasn't let through,
+// with the request's correlation id so the requester doesn't wait for a timeout
+func refusal(m protocol.Msg, text string) protocol.Msg {
+	if m.Type == protocol.RequestMsg {
+		if corr, _, _, ok := protocol.ParseRequestPayload(m.Payload); ok {
+			text = protocol.RequestErrorPayload(corr, text)
+		}
+	}
+	return errorMsg(m.Topic, text)
+}
+
+// writes the error directly to the connection, for when it's going to be closed right after.
+// Nothing else may be writing to it, see serveConn.
+func closeWithError(conn net.Conn, log *slog.Logger, st *serverStats, m protocol.Msg) {
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return
+	}
+	if _, err := m.Encoded().WriteTo(conn); err != nil {
+		log.Info("failed to write error", "err", err)
+		return
+	}
+	st.sent(m.Type)
+}
+
+// WriteBatchConfig sets how many messages are written to a connection at once, and how long the
+// writer waits for more after the first one. Without a delay, only what's already queued is batched.
+type WriteBatchConfig struct {
+	MaxBatch int
+	MaxDelay time.Duration
+}
+
+var defaultWriteBatch = WriteBatchConfig{MaxBatch: 64}
+
+// writeToConn writes the messages queued when it wakes up (and the ones that arrive
+// within the batch delay) with a single write, up to the batch size
+func writeToConn(done <-chan zero, mc <-chan protocol.Msg, backlog *atomic.Int32, conn net.Conn, log *slog.Logger, st *serverStats, wb WriteBatchConfig) {
+	buf := new(bytes.Buffer)
+	batch := make([]protocol.Msg, 0, wb.MaxBatch)
+	var timer *time.Timer
+	if wb.MaxDelay > 0 {
+		timer = time.NewTimer(wb.MaxDelay)
+		timer.Stop()
+	}
+	take := func(m protocol.Msg) {
+		batch = append(batch, m)
+		backlog.Store(int32(len(batch)))
+	}
+	for {
+		batch = batch[:0]
+		backlog.Store(0)
+		select {
+		case <-done:
+			return
+		case m := <-mc:
+			take(m)
+		}
+
+		var delay <-chan time.Time
+		if timer != nil {
+			timer.Reset(wb.MaxDelay)
+			delay = timer.C
+		}
+	collect:
+		for len(batch) < wb.MaxBatch {
+			select {
+			case m := <-mc:
+				take(m)
+				continue
+			default:
+			}
+			if delay == nil {
+				break
+			}
+			select {
+			case <-done:
+				return
+			case m := <-mc:
+				take(m)
+			case <-delay:
+				break collect
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		now := time.Now()
+		buf.Reset()
+		for _, m := range batch {
+			if m.Expired(now) {
+				st.expired.Add(1)
+				continue
+			}
+			if _, err := m.WriteTo(buf); err != nil {
+				log.Error("failed to write message to buffer", "err", err)
+				return
+			}
+			st.sent(m.Type)
+		}
+		if buf.Len() == 0 {
+			continue
+		}
+		if _, err := buf.WriteTo(conn); err != nil {
+			log.Info("failed to write messages to the connection", "err", err)
+			return
+		}
+		st.writeLatency.since(now)
+		st.writes.Add(1)
+	}
+}
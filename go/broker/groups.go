@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"fmt"
+
+	"tccgo/protocol"
+)
+
+// Members of a consumer group subscribe to a topic under a group name,
+// and each publication on the topic is delivered to only one of them.
+// Groups are local to a server: with peers, each server delivers to one member of its own.
+
+// GroupStrategy decides which member of a consumer group gets each publication
+type GroupStrategy uint8
+
+const (
+	RoundRobin = GroupStrategy(iota)
+	LeastLoaded
+)
+
+// ParseGroupStrategy parses "roundrobin" or "leastloaded"
+func ParseGroupStrategy(s string) (GroupStrategy, error) {
+	switch s {
+	case "roundrobin":
+		return RoundRobin, nil
+	case "leastloaded":
+		return LeastLoaded, nil
+	default:
+		return 0, fmt.Errorf("unknown group strategy %q", s)
+	}
+}
+
+type groupKey struct {
+	topic uint16
+	name  string
+}
+
+type consumerGroup struct {
+	members []subscriber
+	next    int // index of the member the next publication goes to, with round-robin
+}
+
+func (g *consumerGroup) add(s subscriber) bool {
+	for _, m := range g.members {
+		if m == s {
+			return false
+		}
+	}
+	g.members = append(g.members, s)
+	return true
+}
+
+// remove keeps the round-robin order of the remaining members
+func (g *consumerGroup) remove(s subscriber) bool {
+	for i, m := range g.members {
+		if m != s {
+			continue
+		}
+		g.members = append(g.members[:i], g.members[i+1:]...)
+		if i < g.next {
+			g.next--
+		}
+		if g.next >= len(g.members) {
+			g.next = 0
+		}
+		return true
+	}
+	return false
+}
+
+// pick chooses the member to deliver the next publication to.
+// With LeastLoaded, it's the one with the least queued messages, ties are broken round-robin.
+func (g *consumerGroup) pick(strategy GroupStrategy) subscriber {
+	n := len(g.members)
+	i := g.next
+	if strategy == LeastLoaded {
+		for j := 1; j < n; j++ {
+			k := (g.next + j) % n
+			if g.members[k].queued() < g.members[i].queued() {
+				i = k
+			}
+		}
+	}
+	g.next = (i + 1) % n
+	return g.members[i]
+}
+
+func (sp serverPartition) handleGroupSubscribe(t uint16, name string, s subscriber) (protocol.Msg, bool) {
+	k := groupKey{t, name}
+	gs, ok := sp.memberships[s]
+	if _, member := gs[k]; !member {
+		if lk := sp.admit(t, s); lk != limitNone {
+			return errorMsg(t, lk.message()), true
+		}
+		if !ok {
+			gs = make(map[groupKey]zero)
+			sp.memberships[s] = gs
+		}
+		gs[k] = zero{}
+		groups, ok := sp.groups[t]
+		if !ok {
+			groups = make(map[string]*consumerGroup)
+			sp.groups[t] = groups
+		}
+		g, ok := groups[name]
+		if !ok {
+			g = new(consumerGroup)
+			groups[name] = g
+		}
+		g.add(s)
+		sp.addLocal(t)
+	}
+	return protocol.Msg{Type: protocol.GroupSubMsg, Topic: t, Payload: name}, true
+}
+
+func (sp serverPartition) leaveGroup(k groupKey, s subscriber) {
+	groups := sp.groups[k.topic]
+	g, ok := groups[k.name]
+	if !ok || !g.remove(s) {
+		return
+	}
+	if len(g.members) == 0 {
+		delete(groups, k.name)
+		if len(groups) == 0 {
+			delete(sp.groups, k.topic)
+		}
+	}
+	s.nsubs.Add(-1)
+	sp.removeLocal(k.topic)
+}
+
+func (sp serverPartition) handleGroupUnsubscribe(t uint16, name string, s subscriber) (protocol.Msg, bool) {
+	k := groupKey{t, name}
+	if gs, ok := sp.memberships[s]; ok {
+		if _, member := gs[k]; member {
+			sp.leaveGroup(k, s)
+			delete(gs, k)
+			if len(gs) == 0 {
+				delete(sp.memberships, s)
+			}
+		}
+	}
+	return protocol.Msg{Type: protocol.GroupUnsubMsg, Topic: t, Payload: name}, true
+}
+
+func (sp serverPartition) leaveGroups(s subscriber) {
+	for k := range sp.memberships[s] {
+		sp.leaveGroup(k, s)
+	}
+	delete(sp.memberships, s)
+}
+
+// publishToGroups delivers m to one member of each group of its topic, and adds them to rs
+func (sp serverPartition) publishToGroups(m protocol.Msg, rs *responderSet) int {
+	groups := sp.groups[m.Topic]
+	for _, g := range groups {
+		s := g.pick(sp.config.groupStrategy)
+		rs.add(s.id)
+		s.send(m)
+	}
+	return len(groups)
+}
@@ -0,0 +1,33 @@
+package broker
+
+import (
+	"testing"
+
+	"tccgo/protocol"
+)
+
+func TestLeastLoaded(t *testing.T) {
+	g := new(consumerGroup)
+	var mcs []chan protocol.Msg
+	for i := range 3 {
+		mc := make(chan protocol.Msg, 1)
+		mcs = append(mcs, mc)
+		g.add(makeSubscriber(uint64(i+1), make(chan zero), mc))
+	}
+	// the first member's writer is stuck on a batch, the second has a message waiting
+	g.members[0].backlog.Store(5)
+	mcs[1] <- protocol.Msg{}
+
+	for range 3 {
+		if s := g.pick(LeastLoaded); s.id != 3 {
+			t.Fatalf("picked conn %d, wanted the idle conn 3", s.id)
+		}
+	}
+	g.members[0].backlog.Store(0)
+	if s := g.pick(LeastLoaded); s.id != 1 {
+		t.Fatalf("picked conn %d, wanted conn 1 once it caught up", s.id)
+	}
+	if s := g.pick(RoundRobin); s.id != 2 {
+		t.Fatalf("picked conn %d with round-robin, wanted conn 2", s.id)
+	}
+}
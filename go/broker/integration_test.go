@@ -0,0 +1,704 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tccgo/protocol"
+)
+
+// checkLeaks fails the test if there are more goroutines at the end than at the start.
+// It must be called before anything that registers cleanups, so it runs after them.
+func checkLeaks(t *testing.T) {
+	t.Helper()
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		// connections close asynchronously, give them a moment
+		deadline := time.Now().Add(2 * time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := runtime.NumGoroutine(); n > before {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Errorf("%d goroutines leaked:\n%s", n-before, buf)
+		}
+	})
+}
+
+// startServer serves sv on an ephemeral port until the test is over
+func startServer(t *testing.T, e Engine, configure func(*server)) (server, string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	sv := makeServer(ctx, 2, e)
+	if configure != nil {
+		configure(&sv)
+	}
+	stop := make(chan zero)
+	sv.start(stop)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan zero)
+	go func() {
+		defer close(served)
+		serve(l, sv)
+	}()
+
+	t.Cleanup(func() {
+		l.Close()
+		<-served
+		cancel()
+		select {
+		case <-sv.conns.empty():
+		case <-time.After(2 * time.Second):
+			t.Error("connections weren't closed")
+		}
+		close(stop)
+	})
+	return sv, l.Addr().String()
+}
+
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dialTest(t *testing.T, address string) testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return testConn{t, conn}
+}
+
+// pipeTest serves a connection through a pipe, whose writes wait for it to be read
+func pipeTest(t *testing.T, sv server) testConn {
+	t.Helper()
+	tc, _ := countedPipeTest(t, sv)
+	return tc
+}
+
+// countedPipeTest is like pipeTest, and counts what the server writes
+func countedPipeTest(t *testing.T, sv server) (testConn, *writeCounter) {
+	t.Helper()
+	client, server := net.Pipe()
+	wc := &writeCounter{Conn: server}
+	done := make(chan zero)
+	go func() {
+		defer close(done)
+		serveConn(wc, sv, peerLink{})
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return testConn{t, client}, wc
+}
+
+// writeCounter counts the writes to a connection, and the ones that aren't made of whole messages
+type writeCounter struct {
+	net.Conn
+	writes  atomic.Int64
+	partial atomic.Int64
+}
+
+func (wc *writeCounter) Write(p []byte) (int, error) {
+	wc.writes.Add(1)
+	for r := bytes.NewReader(p); r.Len() > 0; {
+		var m protocol.Msg
+		if _, err := m.ReadFrom(r); err != nil {
+			wc.partial.Add(1)
+			break
+		}
+	}
+	return wc.Conn.Write(p)
+}
+
+func (tc testConn) send(m protocol.Msg) {
+	tc.t.Helper()
+	if _, err := m.WriteTo(tc.conn); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+func (tc testConn) receive() protocol.Msg {
+	tc.t.Helper()
+	var m protocol.Msg
+	tc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := m.ReadFrom(tc.conn); err != nil {
+		tc.t.Fatalf("failed to receive: %v", err)
+	}
+	return m
+}
+
+func (tc testConn) expect(want protocol.Msg) {
+	tc.t.Helper()
+	if m := tc.receive(); m.Type != want.Type || m.Topic != want.Topic || m.Payload != want.Payload {
+		tc.t.Fatalf("expected %v, got %v", want, m)
+	}
+}
+
+// expectClosed waits for the server to close the connection
+func (tc testConn) expectClosed() {
+	tc.t.Helper()
+	var m protocol.Msg
+	tc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := m.ReadFrom(tc.conn); err == nil {
+		tc.t.Fatalf("expected the connection to be closed, got %v", m)
+	}
+}
+
+func (tc testConn) subscribe(topic uint16) {
+	tc.t.Helper()
+	tc.send(protocol.Msg{Type: protocol.SubMsg, Topic: topic})
+	tc.expect(protocol.Msg{Type: protocol.SubMsg, Topic: topic})
+}
+
+func pub(topic uint16, payload string) protocol.Msg {
+	return protocol.Msg{Type: protocol.PubMsg, Topic: topic, Payload: payload}
+}
+
+// waitFor polls cond, since some effects happen after the connection is closed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func forEachEngine(t *testing.T, f func(t *testing.T, e Engine)) {
+	for _, name := range []string{"channels", "locks"} {
+		t.Run(name, func(t *testing.T) {
+			e, _ := ParseEngine(name)
+			checkLeaks(t)
+			f(t, e)
+		})
+	}
+}
+
+func TestSubscriptionAcks(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		_, address := startServer(t, e, nil)
+		c := dialTest(t, address)
+		c.subscribe(3)
+		// subscribing again is acknowledged too
+		c.subscribe(3)
+		c.send(protocol.Msg{Type: protocol.UnsubMsg, Topic: 3})
+		c.expect(protocol.Msg{Type: protocol.UnsubMsg, Topic: 3})
+	})
+}
+
+func TestFanout(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		_, address := startServer(t, e, nil)
+		subs := make([]testConn, 5)
+		for i := range subs {
+			subs[i] = dialTest(t, address)
+			subs[i].subscribe(8)
+		}
+		other := dialTest(t, address)
+		other.subscribe(9)
+
+		p := dialTest(t, address)
+		p.send(pub(8, "to everyone"))
+		p.send(pub(9, "to the other one"))
+		for _, c := range subs {
+			c.expect(pub(8, "to everyone"))
+		}
+		other.expect(pub(9, "to the other one"))
+	})
+}
+
+func TestUnsubscribeStopsDelivery(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, address := startServer(t, e, nil)
+		c := dialTest(t, address)
+		// in the same partition, so publications to them are delivered in order
+		c.subscribe(1)
+		c.subscribe(3)
+		c.send(protocol.Msg{Type: protocol.UnsubMsg, Topic: 1})
+		c.expect(protocol.Msg{Type: protocol.UnsubMsg, Topic: 1})
+
+		p := dialTest(t, address)
+		p.send(pub(1, "missed"))
+		p.send(pub(3, "marker"))
+		c.expect(pub(3, "marker"))
+		if n := sv.publishCounted(1, "missed again"); n != 0 {
+			t.Errorf("delivered to %d subscribers after unsubscribing", n)
+		}
+	})
+}
+
+func TestUnsubscribeWaitsForDeliveries(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		// without batches, a connection that isn't read holds at most two messages
+		sv, _ := startServer(t, e, func(sv *server) {
+			sv.writes = WriteBatchConfig{MaxBatch: 1}
+		})
+		c := pipeTest(t, sv)
+		// in the same partition as 1, so the marker comes after the publications on 1
+		c.subscribe(3)
+		// the publications wait for the subscribers that don't read,
+		// which usually come before c since they subscribed first
+		var slow []testConn
+		for range 3 {
+			s := pipeTest(t, sv)
+			s.subscribe(1)
+			slow = append(slow, s)
+		}
+		c.subscribe(1)
+
+		received := make(chan protocol.Msg, 16)
+		go func() {
+			for {
+				var m protocol.Msg
+				if _, err := m.ReadFrom(c.conn); err != nil {
+					close(received)
+					return
+				}
+				received <- m
+			}
+		}()
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sv.publish(1, "in flight")
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+		c.send(protocol.Msg{Type: protocol.UnsubMsg, Topic: 1})
+		time.Sleep(50 * time.Millisecond)
+		for _, s := range slow {
+			go io.Copy(io.Discard, s.conn)
+		}
+
+		for m := range received {
+			if m.Type == protocol.UnsubMsg {
+				break
+			}
+		}
+		wg.Wait()
+		sv.publish(3, "marker")
+		if m := <-received; m.Type != protocol.PubMsg || m.Topic != 3 {
+			t.Fatalf("got %v after the unsubscription was acknowledged", m)
+		}
+	})
+}
+
+func TestDisconnectCleanup(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, address := startServer(t, e, nil)
+		c := dialTest(t, address)
+		for topic := range uint16(4) {
+			c.subscribe(topic)
+		}
+		c.conn.Close()
+
+		waitFor(t, "the connection to be removed", func() bool {
+			return len(sv.conns.list()) == 0
+		})
+		for _, pi := range sv.info() {
+			if len(pi.topics) != 0 || len(pi.subscriptions) != 0 {
+				t.Fatalf("subscriptions left after disconnecting: %+v", pi)
+			}
+		}
+		if n := sv.publishCounted(2, "anyone?"); n != 0 {
+			t.Errorf("delivered to %d subscribers after disconnecting", n)
+		}
+	})
+}
+
+func TestPingEcho(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, _ := startServer(t, e, nil)
+		c := pipeTest(t, sv)
+		c.send(protocol.Msg{Type: protocol.PingMsg})
+		c.expect(protocol.Msg{Type: protocol.PingMsg})
+		c.send(protocol.Msg{Type: protocol.PingMsg})
+		c.expect(protocol.Msg{Type: protocol.PingMsg})
+	})
+}
+
+func TestReadTimeout(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, address := startServer(t, e, func(sv *server) {
+			sv.keepalive = KeepaliveConfig{Idle: 100 * time.Millisecond}
+		})
+		c := dialTest(t, address)
+		c.subscribe(1)
+		start := time.Now()
+		c.expectClosed()
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Errorf("closed after %v, before the idle timeout", d)
+		}
+		waitFor(t, "the timeout to be counted", func() bool {
+			return sv.stats.readTimeouts.Load() == 1
+		})
+	})
+}
+
+func TestSumallCommand(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		_, address := startServer(t, e, nil)
+		c := dialTest(t, address)
+		c.subscribe(4)
+		c.send(pub(4, "!sumall hello"))
+		// the command itself isn't delivered, only its result
+		m := c.receive()
+		if m.Type != protocol.PubMsg || m.Payload != Sumall("hello") {
+			t.Fatalf("expected the result of the command, got %v", m)
+		}
+		if strings.HasPrefix(m.Payload, commandPrefix) {
+			t.Fatalf("the command was delivered: %v", m)
+		}
+	})
+}
+
+func TestExpiredWhileQueued(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, _ := startServer(t, e, func(sv *server) {
+			sv.writes = WriteBatchConfig{MaxBatch: 1}
+		})
+		c := pipeTest(t, sv)
+		c.subscribe(1)
+		// the writer waits for c to read the first one, while the second one expires in the queue
+		sv.publish(1, "first")
+		sv.publishExpiring(1, "stale", time.Now().Add(20*time.Millisecond))
+		time.Sleep(50 * time.Millisecond)
+
+		c.expect(pub(1, "first"))
+		sv.publish(1, "fresh")
+		c.expect(pub(1, "fresh"))
+		if n := sv.stats.expired.Load(); n != 1 {
+			t.Errorf("counted %d expired publications, wanted 1", n)
+		}
+	})
+}
+
+func TestCommandAfterStop(t *testing.T) {
+	// the channel engine's partitions aren't there anymore to publish to
+	checkLeaks(t)
+	sv := makeServer(context.Background(), 1, LockEngine)
+	stop := make(chan zero)
+	sv.start(stop)
+	mc := make(chan protocol.Msg, 1)
+	s := sv.conns.add("test", make(chan zero), mc)
+	sv.subscribe(4, s, true)
+	<-mc
+
+	close(stop)
+	sv.publish(4, "!sumall too late")
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case m := <-mc:
+		t.Fatalf("got %v after the engine was stopped", m)
+	default:
+	}
+}
+
+// lockedBuffer collects a log written from several goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+func TestConnectionLog(t *testing.T) {
+	checkLeaks(t)
+	out := new(lockedBuffer)
+	_, address := startServer(t, ChannelEngine, func(sv *server) {
+		sv.log = slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	})
+	c := dialTest(t, address)
+	c.subscribe(1)
+	remote := c.conn.LocalAddr().String()
+	c.conn.Close()
+
+	waitFor(t, "the connection to be closed", func() bool {
+		return strings.Contains(out.String(), "connection closed")
+	})
+	var opened, closed bool
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var r struct {
+			Msg    string `json:"msg"`
+			Conn   uint64 `json:"conn"`
+			Remote string `json:"remote"`
+		}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("not a JSON record: %q", line)
+		}
+		if r.Conn == 0 || r.Remote != remote {
+			continue
+		}
+		opened = opened || r.Msg == "connection opened"
+		closed = closed || r.Msg == "connection closed"
+	}
+	if !opened || !closed {
+		t.Errorf("missing records with the connection's attributes:\n%s", out)
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	checkLeaks(t)
+	sv, address := startServer(t, ChannelEngine, func(sv *server) {
+		sv.limits.setConfig(LimitsConfig{MaxConns: 1})
+	})
+	first := dialTest(t, address)
+	first.subscribe(1)
+	second := dialTest(t, address)
+	second.expect(errorMsg(0, limitConns.message()))
+	second.expectClosed()
+
+	sv.limits.setConfig(LimitsConfig{MaxConns: 2})
+	third := dialTest(t, address)
+	third.subscribe(2)
+	// the connection admitted before is still there
+	third.send(pub(1, "still connected?"))
+	first.expect(pub(1, "still connected?"))
+}
+
+// testACL makes an acl store from the rules
+func testACL(t *testing.T, rules ...string) *aclStore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(path, []byte(strings.Join(rules, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	as, err := makeACLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return as
+}
+
+func TestClaimedUserIsAnonymous(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		// auth is disabled, so claiming to be alice mustn't get past the acl
+		sv, address := startServer(t, e, func(sv *server) {
+			sv.acl = testACL(t, "alice allow pub,sub *")
+		})
+		c := dialTest(t, address)
+		c.send(protocol.Msg{Type: protocol.AuthMsg, Payload: protocol.AuthPayload("alice", "")})
+		c.expect(protocol.Msg{Type: protocol.AuthMsg})
+		c.send(protocol.Msg{Type: protocol.SubMsg, Topic: 1})
+		c.expect(errorMsg(1, "subscribe denied"))
+		c.send(pub(1, "as alice"))
+		c.expect(errorMsg(1, "publish denied"))
+
+		r := respTest(t, sv, nil)
+		r.command("AUTH alice secret\r\n", "+OK\r\n")
+		r.command("PUBLISH 1 hi\r\n", "-NOPERM publish denied\r\n")
+		r.command("SUBSCRIBE 1\r\n", "-NOPERM subscribe denied for '1'\r\n")
+
+		m := mqttTest(t, sv, nil)
+		if code := m.connect("alice", 0); code != mqttAccepted {
+			t.Fatalf("mqtt connect refused with %d", code)
+		}
+		if code := m.subscribe("1"); code != mqttSubscribeFailed {
+			t.Fatalf("mqtt subscribe answered with %d", code)
+		}
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	limited := func(t *testing.T, action RateLimitAction) (server, string) {
+		checkLeaks(t)
+		return startServer(t, ChannelEngine, func(sv *server) {
+			// a publication every 100ms, after the first one
+			sv.rate = makeRateLimiter(RateLimitConfig{ConnRate: 10, ConnBurst: 1, Action: action})
+		})
+	}
+	t.Run("delay", func(t *testing.T) {
+		sv, address := limited(t, RateDelay)
+		c := dialTest(t, address)
+		c.subscribe(1)
+		start := time.Now()
+		for _, p := range []string{"a", "b", "c"} {
+			c.send(pub(1, p))
+		}
+		for _, p := range []string{"a", "b", "c"} {
+			c.expect(pub(1, p))
+		}
+		if d := time.Since(start); d < 150*time.Millisecond {
+			t.Errorf("three publications took %v, faster than the limit", d)
+		}
+		if n := sv.stats.connLimited.Load(); n != 2 {
+			t.Errorf("counted %d delayed publications, wanted 2", n)
+		}
+	})
+	t.Run("drop", func(t *testing.T) {
+		sv, address := limited(t, RateDrop)
+		c, p := dialTest(t, address), dialTest(t, address)
+		c.subscribe(1)
+		p.send(pub(1, "allowed"))
+		p.send(pub(1, "dropped"))
+		p.expect(errorMsg(1, "rate limited"))
+		// from another connection, which has a bucket of its own
+		dialTest(t, address).send(pub(1, "marker"))
+		c.expect(pub(1, "allowed"))
+		c.expect(pub(1, "marker"))
+		if n := sv.stats.connLimited.Load(); n != 1 {
+			t.Errorf("counted %d dropped publications, wanted 1", n)
+		}
+	})
+	t.Run("requests", func(t *testing.T) {
+		// requests fan out like publications, and take from the same buckets
+		_, address := limited(t, RateDrop)
+		c, p := dialTest(t, address), dialTest(t, address)
+		c.subscribe(1)
+		p.send(pub(1, "allowed"))
+		p.send(protocol.Msg{Type: protocol.RequestMsg, Topic: 1, Payload: protocol.RequestPayload(7, time.Second, "dropped")})
+		p.expect(errorMsg(1, protocol.RequestErrorPayload(7, "rate limited")))
+		dialTest(t, address).send(pub(1, "marker"))
+		c.expect(pub(1, "allowed"))
+		c.expect(pub(1, "marker"))
+	})
+	t.Run("disconnect", func(t *testing.T) {
+		_, address := limited(t, RateDisconnect)
+		p := dialTest(t, address)
+		p.send(pub(1, "allowed"))
+		p.send(pub(1, "too fast"))
+		p.expect(errorMsg(1, "rate limited"))
+		p.expectClosed()
+	})
+}
+
+func TestCloseWithErrorFrames(t *testing.T) {
+	checkLeaks(t)
+	sv, _ := startServer(t, ChannelEngine, func(sv *server) {
+		sv.rate = makeRateLimiter(RateLimitConfig{ConnRate: 1, ConnBurst: 1, Action: RateDisconnect})
+	})
+	c, wc := countedPipeTest(t, sv)
+	c.subscribe(1)
+	c.send(pub(1, "allowed"))
+	c.expect(pub(1, "allowed"))
+	c.send(pub(1, "too fast"))
+	c.expect(errorMsg(1, "rate limited"))
+	c.expectClosed()
+	// a message written in pieces can be interleaved with the writer's
+	if n := wc.partial.Load(); n != 0 {
+		t.Errorf("%d writes weren't whole messages", n)
+	}
+}
+
+func TestWriteBatching(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, _ := startServer(t, e, func(sv *server) {
+			sv.writes = WriteBatchConfig{MaxBatch: 4, MaxDelay: 200 * time.Millisecond}
+		})
+		c, wc := countedPipeTest(t, sv)
+		// the ack alone doesn't fill a batch, and is written once the delay is over
+		c.subscribe(1)
+		if n := wc.writes.Load(); n != 1 {
+			t.Fatalf("expected 1 write, got %d", n)
+		}
+
+		for i := range 4 {
+			sv.publish(1, strconv.Itoa(i))
+		}
+		for i := range 4 {
+			c.expect(pub(1, strconv.Itoa(i)))
+		}
+		if n := wc.writes.Load(); n != 2 {
+			t.Fatalf("expected the batch in 1 more write, got %d writes", n)
+		}
+
+		sv.publish(1, "alone")
+		c.expect(pub(1, "alone"))
+		if n := wc.writes.Load(); n != 3 {
+			t.Fatalf("expected the partial batch in 1 more write, got %d writes", n)
+		}
+		if n := wc.partial.Load(); n != 0 {
+			t.Errorf("%d writes weren't whole messages", n)
+		}
+	})
+}
+
+func TestPeerLinks(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, address := startServer(t, e, nil)
+		c := dialTest(t, address)
+		c.send(protocol.Msg{Type: protocol.PeerMsg, Payload: "client"})
+		c.expect(errorMsg(0, errPeerRefused.Error()))
+		c.expectClosed()
+
+		// only from the address of a configured peer
+		sv.peers.addresses = []string{"127.0.0.1:1"}
+		p := dialTest(t, address)
+		p.send(protocol.Msg{Type: protocol.PeerMsg, Payload: "peer"})
+		p.expect(protocol.Msg{Type: protocol.PeerMsg, Payload: sv.node})
+	})
+}
+
+func TestRequestReply(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		_, address := startServer(t, e, nil)
+		requester, responder, forger := dialTest(t, address), dialTest(t, address), dialTest(t, address)
+		responder.subscribe(5)
+
+		request := func(corr uint32, timeout time.Duration) (inbox uint64) {
+			t.Helper()
+			requester.send(protocol.Msg{Type: protocol.RequestMsg, Topic: 5, Payload: protocol.RequestPayload(corr, timeout, "question")})
+			m := responder.receive()
+			inbox, c, data, ok := protocol.ParseRoutedPayload(m.Payload)
+			if m.Type != protocol.RequestMsg || !ok || c != corr || data != "question" {
+				t.Fatalf("responder got %v", m)
+			}
+			return inbox
+		}
+		reply := func(tc testConn, inbox uint64, corr uint32, data string) {
+			tc.send(protocol.Msg{Type: protocol.ReplyMsg, Topic: 5, Payload: protocol.RoutedPayload(inbox, corr, data)})
+			// the reply is handled once the ping comes back
+			tc.send(protocol.Msg{Type: protocol.PingMsg})
+			tc.expect(protocol.Msg{Type: protocol.PingMsg})
+		}
+
+		inbox := request(1, time.Second)
+		reply(responder, inbox, 1, "answer")
+		requester.expect(protocol.Msg{Type: protocol.ReplyMsg, Topic: 5, Payload: protocol.ReplyPayload(1, "answer")})
+
+		// only the connections the request was delivered to can reply
+		inbox = request(2, time.Second)
+		reply(forger, inbox, 2, "forged")
+		reply(responder, inbox, 2, "answer")
+		requester.expect(protocol.Msg{Type: protocol.ReplyMsg, Topic: 5, Payload: protocol.ReplyPayload(2, "answer")})
+
+		request(3, 50*time.Millisecond)
+		requester.expect(errorMsg(5, protocol.RequestErrorPayload(3, "timed out")))
+	})
+}
@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+)
+
+// KeepaliveConfig bounds how long a dead connection goes unnoticed: with pings it's
+// at most Ping+Pong, otherwise Idle. Clients can ask for it with a KeepaliveMsg.
+type KeepaliveConfig struct {
+	Idle time.Duration // connections that send nothing for this long are closed
+	Ping time.Duration // connections quiet for this long are pinged, 0 to never ping them
+	Pong time.Duration // how long a pinged connection has to answer
+}
+
+var defaultKeepalive = KeepaliveConfig{
+	Idle: 1 * time.Minute,
+	Pong: 10 * time.Second,
+}
+
+func (c KeepaliveConfig) validate() error {
+	if c.Idle <= 0 || c.Ping < 0 || (c.Ping > 0 && c.Pong <= 0) {
+		return fmt.Errorf("invalid keepalive: idle %v, ping %v, pong %v", c.Idle, c.Ping, c.Pong)
+	}
+	return nil
+}
+
+// keepalive tracks when a connection was last heard from, to set its read deadlines
+type keepalive struct {
+	config   KeepaliveConfig
+	lastRead time.Time
+	pinged   time.Time // when the unanswered ping was sent, zero if there's none
+}
+
+func makeKeepalive(c KeepaliveConfig, now time.Time) keepalive {
+	return keepalive{config: c, lastRead: now}
+}
+
+func (ka *keepalive) deadline() time.Time {
+	d := ka.lastRead.Add(ka.config.Idle)
+	if ka.config.Ping > 0 {
+		next := ka.lastRead.Add(ka.config.Ping)
+		if !ka.pinged.IsZero() {
+			next = ka.pinged.Add(ka.config.Pong)
+		}
+		if next.Before(d) {
+			d = next
+		}
+	}
+	return d
+}
+
+// timedOut tells whether the connection should be pinged instead of closed after a read timed out
+func (ka *keepalive) timedOut(now time.Time) bool {
+	if ka.config.Ping == 0 || !ka.pinged.IsZero() || !now.Before(ka.lastRead.Add(ka.config.Idle)) {
+		return false
+	}
+	ka.pinged = now
+	return true
+}
+
+// received tells whether the server was waiting for an answer to a ping, which any message is
+func (ka *keepalive) received(now time.Time) bool {
+	pong := !ka.pinged.IsZero()
+	ka.lastRead, ka.pinged = now, time.Time{}
+	return pong
+}
@@ -0,0 +1,170 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type limitKind uint8
+
+const (
+	limitNone = limitKind(iota)
+	limitConns
+	limitConnsPerIP
+	limitAddress
+	limitSubsPerConn
+	limitSubsPerTopic
+	numLimitKinds
+)
+
+func (k limitKind) name() string {
+	switch k {
+	case limitConns:
+		return "connections"
+	case limitConnsPerIP:
+		return "connections_per_ip"
+	case limitAddress:
+		return "address"
+	case limitSubsPerConn:
+		return "subscriptions_per_connection"
+	case limitSubsPerTopic:
+		return "subscribers_per_topic"
+	default:
+		return "none"
+	}
+}
+
+// text of the error message sent to the client
+func (k limitKind) message() string {
+	switch k {
+	case limitConns:
+		return "too many connections"
+	case limitConnsPerIP:
+		return "too many connections from this address"
+	case limitAddress:
+		return "address not allowed"
+	case limitSubsPerConn:
+		return "too many subscriptions"
+	case limitSubsPerTopic:
+		return "too many subscribers"
+	default:
+		return ""
+	}
+}
+
+// LimitsConfig bounds the resources clients can take.
+// Zero means no limit, an empty allow list means every address is allowed.
+type LimitsConfig struct {
+	MaxConns        int
+	MaxConnsPerIP   int
+	MaxSubsPerConn  int
+	MaxSubsPerTopic int
+	Allow           []*net.IPNet
+	Deny            []*net.IPNet
+}
+
+// ParseCIDRs parses a comma-separated list of CIDRs
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var r []*net.IPNet
+	for _, c := range strings.Split(s, ",") {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("cidr %q: %w", c, err)
+		}
+		r = append(r, n)
+	}
+	return r, nil
+}
+
+func anyContains(ns []*net.IPNet, ip net.IP) bool {
+	for _, n := range ns {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type resourceLimiter struct {
+	config   atomic.Pointer[LimitsConfig] // replaced as a whole, see setConfig
+	rejected [numLimitKinds]atomic.Int64
+
+	mu    sync.Mutex
+	conns int
+	perIP map[string]int
+}
+
+func makeResourceLimiter(config LimitsConfig) *resourceLimiter {
+	rl := &resourceLimiter{perIP: make(map[string]int)}
+	rl.setConfig(config)
+	return rl
+}
+
+func (rl *resourceLimiter) setConfig(c LimitsConfig) {
+	rl.config.Store(&c)
+}
+
+func (rl *resourceLimiter) reject(k limitKind) limitKind {
+	rl.rejected[k].Add(1)
+	return k
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		return ta.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// acquire admits a new connection from ip, which must be released later if the result is limitNone
+func (rl *resourceLimiter) acquire(ip net.IP) limitKind {
+	c := rl.config.Load()
+	if ip != nil {
+		if anyContains(c.Deny, ip) || (len(c.Allow) > 0 && !anyContains(c.Allow, ip)) {
+			return rl.reject(limitAddress)
+		}
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if c.MaxConns > 0 && rl.conns >= c.MaxConns {
+		return rl.reject(limitConns)
+	}
+	key := ip.String()
+	if c.MaxConnsPerIP > 0 && rl.perIP[key] >= c.MaxConnsPerIP {
+		return rl.reject(limitConnsPerIP)
+	}
+	rl.conns++
+	rl.perIP[key]++
+	return limitNone
+}
+
+func (rl *resourceLimiter) release(ip net.IP) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.conns--
+	key := ip.String()
+	if rl.perIP[key] <= 1 {
+		delete(rl.perIP, key)
+	} else {
+		rl.perIP[key]--
+	}
+}
+
+func (rl *resourceLimiter) rejections() map[string]int64 {
+	r := make(map[string]int64)
+	for k := limitNone + 1; k < numLimitKinds; k++ {
+		r[k.name()] = rl.rejected[k].Load()
+	}
+	return r
+}
@@ -0,0 +1,196 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tccgo/protocol"
+)
+
+var (
+	latencyBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+	fanoutBuckets  = []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+)
+
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // counts[i] is the number of observations <= bounds[i], not cumulative
+	sum    float64
+	count  uint64
+}
+
+func makeHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) since(t time.Time) {
+	h.observe(time.Since(t).Seconds())
+}
+
+type histogramSnapshot struct {
+	bounds     []float64
+	cumulative []uint64
+	sum        float64
+	count      uint64
+}
+
+func (h *histogram) snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hs := histogramSnapshot{
+		bounds:     h.bounds,
+		cumulative: make([]uint64, len(h.counts)),
+		sum:        h.sum,
+		count:      h.count,
+	}
+	acc := uint64(0)
+	for i, c := range h.counts {
+		acc += c
+		hs.cumulative[i] = acc
+	}
+	return hs
+}
+
+type partitionStats struct {
+	chanWait *histogram
+	fanout   *histogram
+	compute  *histogram
+	expired  atomic.Int64 // publications that expired before reaching the partition
+}
+
+func makePartitionStats() *partitionStats {
+	return &partitionStats{
+		chanWait: makeHistogram(latencyBuckets),
+		fanout:   makeHistogram(fanoutBuckets),
+		compute:  makeHistogram(latencyBuckets),
+	}
+}
+
+// metricsWriter writes the prometheus text exposition format
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (mw *metricsWriter) printf(f string, a ...any) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = fmt.Fprintf(mw.w, f, a...)
+}
+
+func (mw *metricsWriter) header(name, typ, help string) {
+	mw.printf("# HELP %s %s\n", name, help)
+	mw.printf("# TYPE %s %s\n", name, typ)
+}
+
+func (mw *metricsWriter) value(name string, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	mw.printf("%s%s %s\n", name, labels, formatFloat(v))
+}
+
+func (mw *metricsWriter) histogram(name string, labels string, hs histogramSnapshot) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range hs.bounds {
+		mw.printf("%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(b), hs.cumulative[i])
+	}
+	mw.printf("%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, hs.count)
+	mw.value(name+"_sum", labels, hs.sum)
+	mw.value(name+"_count", labels, float64(hs.count))
+}
+
+func (mw *metricsWriter) byType(name string, cs *[256]atomic.Int64) {
+	for t := range cs {
+		if n := cs[t].Load(); n > 0 {
+			mw.value(name, fmt.Sprintf("type=%q", protocol.MsgType(t).Name()), float64(n))
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeMetrics(w io.Writer, st *serverStats, limits *resourceLimiter) error {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+
+	mw.header("tcc_connections", "gauge", "Number of open connections.")
+	mw.value("tcc_connections", "", float64(st.connections()))
+	mw.header("tcc_connections_accepted_total", "counter", "Number of accepted connections.")
+	mw.value("tcc_connections_accepted_total", "", float64(st.accepted.Load()))
+	mw.header("tcc_connections_closed_total", "counter", "Number of closed connections.")
+	mw.value("tcc_connections_closed_total", "", float64(st.closed.Load()))
+	mw.header("tcc_read_timeouts_total", "counter", "Number of connections closed because of a read timeout.")
+	mw.value("tcc_read_timeouts_total", "", float64(st.readTimeouts.Load()))
+
+	mw.header("tcc_rate_limited_total", "counter", "Number of publications that exceeded a rate limit, by scope.")
+	mw.value("tcc_rate_limited_total", `scope="connection"`, float64(st.connLimited.Load()))
+	mw.value("tcc_rate_limited_total", `scope="topic"`, float64(st.topicLimited.Load()))
+
+	mw.header("tcc_expired_total", "counter", "Number of publications dropped because their time-to-live ran out.")
+	mw.value("tcc_expired_total", "", float64(st.expirations()))
+
+	mw.header("tcc_sessions_resumed_total", "counter", "Number of sessions resumed by a new connection.")
+	mw.value("tcc_sessions_resumed_total", "", float64(st.resumed.Load()))
+	mw.header("tcc_session_dropped_total", "counter", "Number of publications dropped because a detached session's buffer was full.")
+	mw.value("tcc_session_dropped_total", "", float64(st.sessionDrops.Load()))
+
+	mw.header("tcc_limit_rejections_total", "counter", "Number of connections or subscriptions rejected by a resource limit, by limit.")
+	for k := limitNone + 1; k < numLimitKinds; k++ {
+		mw.value("tcc_limit_rejections_total", fmt.Sprintf("limit=%q", k.name()), float64(limits.rejected[k].Load()))
+	}
+
+	mw.header("tcc_messages_in_total", "counter", "Number of messages received, by type.")
+	mw.byType("tcc_messages_in_total", &st.msgsIn)
+	mw.header("tcc_messages_out_total", "counter", "Number of messages sent, by type.")
+	mw.byType("tcc_messages_out_total", &st.msgsOut)
+
+	mw.header("tcc_connection_writes_total", "counter", "Number of writes to connections, each with a batch of messages.")
+	mw.value("tcc_connection_writes_total", "", float64(st.writes.Load()))
+	mw.header("tcc_write_duration_seconds", "histogram", "Time taken to write a batch of messages to a connection.")
+	mw.histogram("tcc_write_duration_seconds", "", st.writeLatency.snapshot())
+
+	mw.header("tcc_partition_channel_wait_seconds", "histogram", "Time spent waiting to hand a request to a partition.")
+	for i, ps := range st.parts {
+		mw.histogram("tcc_partition_channel_wait_seconds", fmt.Sprintf("partition=\"%d\"", i), ps.chanWait.snapshot())
+	}
+	mw.header("tcc_partition_fanout_size", "histogram", "Number of subscribers a publication was delivered to.")
+	for i, ps := range st.parts {
+		mw.histogram("tcc_partition_fanout_size", fmt.Sprintf("partition=\"%d\"", i), ps.fanout.snapshot())
+	}
+	mw.header("tcc_partition_compute_duration_seconds", "histogram", "Time taken to run compute commands like !sumall.")
+	for i, ps := range st.parts {
+		mw.histogram("tcc_partition_compute_duration_seconds", fmt.Sprintf("partition=\"%d\"", i), ps.compute.snapshot())
+	}
+
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
@@ -0,0 +1,509 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tccgo/protocol"
+)
+
+// A subset of MQTT 3.1.1: CONNECT, SUBSCRIBE, UNSUBSCRIBE, PUBLISH with QoS 0, PINGREQ and DISCONNECT.
+// MQTT connections are subscribers of the same partitions as native ones.
+// Topic names are mapped to topics with topicNames.
+
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+const (
+	mqttAccepted        = 0
+	mqttBadVersion      = 1
+	mqttUnavailable     = 3
+	mqttBadCredentials  = 4
+	mqttSubscribeFailed = 0x80
+)
+
+// the largest publish with a payload that fits in a message: topic name, packet id and payload
+const mqttMaxPacket = 2 + 1<<16 - 1 + 2 + protocol.MaxPayload
+
+var (
+	errMalformed    = errors.New("malformed mqtt packet")
+	errMQTTTooLarge = errors.New("mqtt packet too large")
+)
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readMQTTPacket(r *bufio.Reader) (mqttPacket, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+	p := mqttPacket{kind: b >> 4, flags: b & 0x0F}
+
+	size := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return mqttPacket{}, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		size |= int(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if size > mqttMaxPacket {
+		return mqttPacket{}, errMQTTTooLarge
+	}
+	p.body = make([]byte, size)
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return mqttPacket{}, err
+	}
+	return p, nil
+}
+
+func appendMQTTPacket(bs []byte, kind, flags byte, body []byte) []byte {
+	bs = append(bs, kind<<4|flags)
+	size := len(body)
+	for {
+		b := byte(size & 0x7F)
+		size >>= 7
+		if size > 0 {
+			b |= 0x80
+		}
+		bs = append(bs, b)
+		if size == 0 {
+			break
+		}
+	}
+	return append(bs, body...)
+}
+
+func appendMQTTString(bs []byte, s string) []byte {
+	bs = binary.BigEndian.AppendUint16(bs, uint16(len(s)))
+	return append(bs, s...)
+}
+
+// mqttReader consumes the body of a packet
+type mqttReader struct {
+	bs  []byte
+	err error
+}
+
+func (mr *mqttReader) uint16() uint16 {
+	if len(mr.bs) < 2 {
+		mr.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(mr.bs)
+	mr.bs = mr.bs[2:]
+	return v
+}
+
+func (mr *mqttReader) byte() byte {
+	if len(mr.bs) < 1 {
+		mr.err = errMalformed
+		return 0
+	}
+	v := mr.bs[0]
+	mr.bs = mr.bs[1:]
+	return v
+}
+
+func (mr *mqttReader) string() string {
+	n := int(mr.uint16())
+	if len(mr.bs) < n {
+		mr.err = errMalformed
+		return ""
+	}
+	s := string(mr.bs[:n])
+	mr.bs = mr.bs[n:]
+	return s
+}
+
+func serveMQTT(l net.Listener, sv server, tn topicNames) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			sv.log.Error("failed to accept connection", "proto", "mqtt", "err", err)
+			continue
+		}
+		go handleMQTTConn(conn, sv, tn)
+	}
+}
+
+// a SUBSCRIBE waiting for the partitions to answer before its SUBACK is sent
+type mqttPendingSub struct {
+	id      uint16
+	topics  []uint16
+	codes   []byte
+	waiting []bool
+	left    int
+}
+
+type mqttConn struct {
+	conn net.Conn
+	sv   server
+	log  *slog.Logger
+
+	mu      sync.Mutex
+	names   map[uint16]string // name each topic was subscribed with, to publish under
+	pending []*mqttPendingSub
+}
+
+func (mc *mqttConn) write(bs []byte) error {
+	if err := mc.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	_, err := mc.conn.Write(bs)
+	return err
+}
+
+func handleMQTTConn(conn net.Conn, sv server, tn topicNames) {
+	ip := remoteIP(conn.RemoteAddr())
+	k := sv.limits.acquire(ip)
+	if k == limitNone {
+		defer sv.limits.release(ip)
+	}
+
+	ctx, cancel := context.WithCancel(sv.ctx)
+	defer cancel()
+
+	r := bufio.NewReader(conn)
+	mc := &mqttConn{
+		conn:  conn,
+		sv:    sv,
+		log:   sv.log.With("proto", "mqtt", "remote", conn.RemoteAddr().String()),
+		names: make(map[uint16]string),
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(sv.keepalive.Idle)); err != nil {
+		conn.Close()
+		return
+	}
+	p, err := readMQTTPacket(r)
+	if err != nil || p.kind != mqttConnect {
+		conn.Close()
+		return
+	}
+	// a rejected client is told so in the CONNACK, which answers a CONNECT, so that it backs off
+	if k != limitNone {
+		mc.log.Info("connection rejected", "reason", k.message())
+		mc.write(appendMQTTPacket(nil, mqttConnack, 0, []byte{0, mqttUnavailable}))
+		conn.Close()
+		return
+	}
+	username, keepalive, code := mc.connect(p)
+	if err := mc.write(appendMQTTPacket(nil, mqttConnack, 0, []byte{0, code})); err != nil || code != mqttAccepted {
+		conn.Close()
+		return
+	}
+
+	msgs := make(chan protocol.Msg, 1)
+	s := sv.conns.add(conn.RemoteAddr().String(), ctx.Done(), msgs)
+	id := s.id
+	sv.conns.identify(id, username)
+	mc.log = mc.log.With("conn", id)
+	mc.log.Debug("connection opened", "user", username)
+	sv.stats.accepted.Add(1)
+
+	context.AfterFunc(ctx, func() {
+		if err := conn.Close(); err != nil {
+			mc.log.Warn("failed to close connection", "err", err)
+		}
+		sv.disconnect(s)
+		sv.conns.remove(id)
+		sv.stats.closed.Add(1)
+		mc.log.Debug("connection closed")
+	})
+
+	go mc.writeMessages(ctx.Done(), msgs, s.backlog)
+
+	var limit connLimit
+	if sv.rate != nil {
+		limit = sv.rate.forConn()
+	}
+
+	for {
+		// a client that doesn't ask for a keepalive still gets the server's idle timeout
+		deadline := time.Now().Add(sv.keepalive.Idle)
+		if keepalive > 0 {
+			deadline = time.Now().Add(keepalive * 3 / 2)
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return
+		}
+		p, err := readMQTTPacket(r)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				sv.stats.readTimeouts.Add(1)
+			}
+			if err != io.EOF {
+				mc.log.Info("failed to read packet", "err", err)
+			}
+			return
+		}
+
+		switch p.kind {
+		case mqttPingreq:
+			err = mc.write(appendMQTTPacket(nil, mqttPingresp, 0, nil))
+		case mqttPublish:
+			err = mc.publish(p, username, limit, tn)
+		case mqttSubscribe:
+			err = mc.subscribe(p, s, username, tn)
+		case mqttUnsubscribe:
+			err = mc.unsubscribe(p, s, tn)
+		case mqttDisconnect:
+			return
+		default:
+			err = fmt.Errorf("unsupported packet type %d", p.kind)
+		}
+		if err != nil {
+			mc.log.Warn("closing connection", "err", err)
+			return
+		}
+	}
+}
+
+func (mc *mqttConn) connect(p mqttPacket) (username string, keepalive time.Duration, code byte) {
+	mr := &mqttReader{bs: p.body}
+	proto := mr.string()
+	level := mr.byte()
+	flags := mr.byte()
+	keepalive = time.Duration(mr.uint16()) * time.Second
+	_ = mr.string() // client id
+	if flags&0x04 != 0 {
+		_ = mr.string() // will topic
+		_ = mr.string() // will message
+	}
+	var password string
+	if flags&0x80 != 0 {
+		username = mr.string()
+	}
+	if flags&0x40 != 0 {
+		password = mr.string()
+	}
+	if mr.err != nil || proto != "MQTT" || level != 4 {
+		return "", 0, mqttBadVersion
+	}
+
+	if mc.sv.auth == nil {
+		// the name can't be checked, so it's anonymous to the acl
+		return "", keepalive, mqttAccepted
+	}
+	if err := mc.sv.auth.Authenticate(username, password); err != nil {
+		if err != errBadCredentials {
+			mc.log.Warn("failed to authenticate", "user", username, "err", err)
+		}
+		return "", 0, mqttBadCredentials
+	}
+	return username, keepalive, mqttAccepted
+}
+
+func (mc *mqttConn) publish(p mqttPacket, username string, limit connLimit, tn topicNames) error {
+	if qos := (p.flags >> 1) & 0x03; qos != 0 {
+		return fmt.Errorf("unsupported publish qos %d", qos)
+	}
+	mr := &mqttReader{bs: p.body}
+	name := mr.string()
+	if mr.err != nil {
+		return mr.err
+	}
+	if len(mr.bs) > protocol.MaxPayload {
+		return fmt.Errorf("publish payload of %d bytes is too large", len(mr.bs))
+	}
+	mc.sv.stats.received(protocol.PubMsg)
+
+	// QoS 0 publications can't be rejected, so they're dropped
+	t, ok := tn.topic(name)
+	if !ok {
+		return nil
+	}
+	sv := mc.sv
+	if sv.config.isPresenceTopic(t) || (sv.acl != nil && !sv.acl.allowed(username, aclPub, t)) {
+		return nil
+	}
+	if sv.rate != nil && limit.check(t, sv.stats) != noViolation {
+		switch sv.rate.config.Action {
+		case RateDrop:
+			return nil
+		case RateDisconnect:
+			return errors.New("rate limited")
+		}
+	}
+	sv.publish(t, string(mr.bs))
+	return nil
+}
+
+func (mc *mqttConn) subscribe(p mqttPacket, s subscriber, username string, tn topicNames) error {
+	mr := &mqttReader{bs: p.body}
+	ps := &mqttPendingSub{id: mr.uint16()}
+	var names []string
+	for len(mr.bs) > 0 && mr.err == nil {
+		names = append(names, mr.string())
+		_ = mr.byte() // requested qos, always granted 0
+	}
+	if mr.err != nil || len(names) == 0 {
+		return errMalformed
+	}
+
+	ps.topics = make([]uint16, len(names))
+	ps.codes = make([]byte, len(names))
+	ps.waiting = make([]bool, len(names))
+	var toSubscribe []uint16
+	for i, name := range names {
+		t, ok := tn.topic(name)
+		if !ok || (mc.sv.acl != nil && !mc.sv.acl.allowed(username, aclSub, t)) {
+			ps.codes[i] = mqttSubscribeFailed
+			continue
+		}
+		ps.topics[i] = t
+		ps.waiting[i] = true
+		ps.left++
+		toSubscribe = append(toSubscribe, t)
+	}
+
+	mc.mu.Lock()
+	for i, name := range names {
+		if ps.waiting[i] {
+			mc.names[ps.topics[i]] = name
+		}
+	}
+	mc.pending = append(mc.pending, ps)
+	mc.mu.Unlock()
+
+	for _, t := range toSubscribe {
+		mc.sv.stats.received(protocol.SubMsg)
+		mc.sv.subscribe(t, s, true)
+	}
+	return mc.flushSubacks()
+}
+
+func (mc *mqttConn) unsubscribe(p mqttPacket, s subscriber, tn topicNames) error {
+	mr := &mqttReader{bs: p.body}
+	id := mr.uint16()
+	for len(mr.bs) > 0 && mr.err == nil {
+		name := mr.string()
+		if t, ok := tn.topic(name); ok && mr.err == nil {
+			mc.mu.Lock()
+			delete(mc.names, t)
+			mc.mu.Unlock()
+			mc.sv.stats.received(protocol.UnsubMsg)
+			mc.sv.subscribe(t, s, false)
+		}
+	}
+	if mr.err != nil {
+		return mr.err
+	}
+	return mc.write(appendMQTTPacket(nil, mqttUnsuback, 0, binary.BigEndian.AppendUint16(nil, id)))
+}
+
+// acknowledge marks the first pending subscription of t as answered by the partition
+func (mc *mqttConn) acknowledge(t uint16, code byte) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, ps := range mc.pending {
+		for i := range ps.topics {
+			if ps.waiting[i] && ps.topics[i] == t {
+				ps.waiting[i] = false
+				ps.codes[i] = code
+				ps.left--
+				return
+			}
+		}
+	}
+}
+
+// flushSubacks sends the SUBACKs of the pending subscriptions that were fully answered, in order
+func (mc *mqttConn) flushSubacks() error {
+	// the lock is held while writing so SUBACKs don't get reordered
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	var bs []byte
+	for len(mc.pending) > 0 && mc.pending[0].left == 0 {
+		ps := mc.pending[0]
+		mc.pending = mc.pending[1:]
+		body := binary.BigEndian.AppendUint16(nil, ps.id)
+		body = append(body, ps.codes...)
+		bs = appendMQTTPacket(bs, mqttSuback, 0, body)
+	}
+	if len(bs) == 0 {
+		return nil
+	}
+	return mc.write(bs)
+}
+
+func (mc *mqttConn) writeMessages(done <-chan zero, msgs <-chan protocol.Msg, backlog *atomic.Int32) {
+	for {
+		backlog.Store(0)
+		select {
+		case <-done:
+			return
+		case m := <-msgs:
+			backlog.Store(1)
+			if m.Expired(time.Now()) {
+				mc.sv.stats.expired.Add(1)
+				continue
+			}
+			var err error
+			switch m.Type {
+			case protocol.SubMsg:
+				mc.acknowledge(m.Topic, 0)
+				err = mc.flushSubacks()
+			case protocol.ErrMsg:
+				mc.acknowledge(m.Topic, mqttSubscribeFailed)
+				err = mc.flushSubacks()
+			case protocol.PubMsg:
+				mc.mu.Lock()
+				name, ok := mc.names[m.Topic]
+				mc.mu.Unlock()
+				if !ok {
+					name = strconv.Itoa(int(m.Topic))
+				}
+				body := appendMQTTString(nil, name)
+				body = append(body, m.Payload...)
+				start := time.Now()
+				err = mc.write(appendMQTTPacket(nil, mqttPublish, 0, body))
+				mc.sv.stats.writeLatency.since(start)
+			default:
+				continue
+			}
+			if err != nil {
+				mc.log.Info("failed to write to the connection", "err", err)
+				mc.conn.Close()
+				return
+			}
+			mc.sv.stats.sent(m.Type)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMQTTPacketSize(t *testing.T) {
+	// a remaining length of 256MB, with nothing after it
+	r := bufio.NewReader(bytes.NewReader([]byte{mqttPublish << 4, 0xFF, 0xFF, 0xFF, 0x7F}))
+	if _, err := readMQTTPacket(r); err != errMQTTTooLarge {
+		t.Fatalf("expected %v, got %v", errMQTTTooLarge, err)
+	}
+
+	body := appendMQTTString(nil, "t")
+	body = append(body, make([]byte, 100)...)
+	r = bufio.NewReader(bytes.NewReader(appendMQTTPacket(nil, mqttPublish, 0, body)))
+	p, err := readMQTTPacket(r)
+	if err != nil || !bytes.Equal(p.body, body) {
+		t.Fatalf("failed to read a publish: %v", err)
+	}
+}
+
+// mqttTestConn is an MQTT connection served through a pipe
+type mqttTestConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func mqttTest(t *testing.T, sv server, tn topicNames) mqttTestConn {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan zero)
+	go func() {
+		defer close(done)
+		handleMQTTConn(server, sv, tn)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return mqttTestConn{t, client, bufio.NewReader(client)}
+}
+
+func (mt mqttTestConn) send(kind, flags byte, body []byte) {
+	mt.t.Helper()
+	mt.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := mt.conn.Write(appendMQTTPacket(nil, kind, flags, body)); err != nil {
+		mt.t.Fatal(err)
+	}
+}
+
+func (mt mqttTestConn) receive() mqttPacket {
+	mt.t.Helper()
+	mt.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p, err := readMQTTPacket(mt.r)
+	if err != nil {
+		mt.t.Fatalf("failed to receive: %v", err)
+	}
+	return p
+}
+
+func (mt mqttTestConn) expect(kind byte, body []byte) {
+	mt.t.Helper()
+	if p := mt.receive(); p.kind != kind || !bytes.Equal(p.body, body) {
+		mt.t.Fatalf("expected packet %d %v, got %d %v", kind, body, p.kind, p.body)
+	}
+}
+
+// connect sends a CONNECT with the username, if any, and returns the CONNACK's code
+func (mt mqttTestConn) connect(username string, keepalive uint16) byte {
+	mt.t.Helper()
+	body := appendMQTTString(nil, "MQTT")
+	flags := byte(0x02) // clean session
+	if username != "" {
+		flags |= 0x80
+	}
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, keepalive)
+	body = appendMQTTString(body, "test")
+	if username != "" {
+		body = appendMQTTString(body, username)
+	}
+	mt.send(mqttConnect, 0, body)
+	p := mt.receive()
+	if p.kind != mqttConnack || len(p.body) != 2 {
+		mt.t.Fatalf("expected a CONNACK, got %d %v", p.kind, p.body)
+	}
+	return p.body[1]
+}
+
+// subscribe subscribes to one topic name with packet id 1, and returns the SUBACK's code
+func (mt mqttTestConn) subscribe(name string) byte {
+	mt.t.Helper()
+	body := binary.BigEndian.AppendUint16(nil, 1)
+	body = appendMQTTString(body, name)
+	mt.send(mqttSubscribe, 0x02, append(body, 0))
+	p := mt.receive()
+	if p.kind != mqttSuback || len(p.body) != 3 {
+		mt.t.Fatalf("expected a SUBACK, got %d %v", p.kind, p.body)
+	}
+	return p.body[2]
+}
+
+func mqttPublishBody(name, payload string) []byte {
+	return append(appendMQTTString(nil, name), payload...)
+}
+
+func TestMQTTIdleTimeout(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, _ := startServer(t, e, func(sv *server) {
+			sv.keepalive = KeepaliveConfig{Idle: 100 * time.Millisecond}
+		})
+		c := mqttTest(t, sv, nil)
+		// without a keepalive of its own
+		if code := c.connect("", 0); code != mqttAccepted {
+			t.Fatalf("connect refused with %d", code)
+		}
+		c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if p, err := readMQTTPacket(c.r); err == nil {
+			t.Fatalf("expected the connection to be closed, got packet %d", p.kind)
+		}
+		waitFor(t, "the timeout to be counted", func() bool {
+			return sv.stats.readTimeouts.Load() == 1
+		})
+	})
+}
+
+func TestMQTTConnectionLimit(t *testing.T) {
+	sv, _ := startServer(t, ChannelEngine, nil)
+	sv.limits.setConfig(LimitsConfig{MaxConns: 1})
+
+	c1 := mqttTest(t, sv, nil)
+	if code := c1.connect("", 0); code != mqttAccepted {
+		t.Fatalf("connect refused with %d", code)
+	}
+	c2 := mqttTest(t, sv, nil)
+	if code := c2.connect("", 0); code != mqttUnavailable {
+		t.Fatalf("expected the connect to be refused with %d, got %d", mqttUnavailable, code)
+	}
+	c2.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if p, err := readMQTTPacket(c2.r); err == nil {
+		t.Fatalf("expected the connection to be closed, got packet %d", p.kind)
+	}
+	if n := sv.limits.rejected[limitConns].Load(); n != 1 {
+		t.Fatalf("expected 1 rejection, got %d", n)
+	}
+}
+
+func TestMQTTEndToEnd(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, _ := startServer(t, e, nil)
+		c := mqttTest(t, sv, topicNames{"sensors/temp": 7})
+		if code := c.connect("", 60); code != mqttAccepted {
+			t.Fatalf("connect refused with %d", code)
+		}
+		if code := c.subscribe("sensors/temp"); code != 0 {
+			t.Fatalf("subscribe refused with %d", code)
+		}
+
+		// publications cross from one protocol to the other, under the subscribed name
+		n := pipeTest(t, sv)
+		n.subscribe(7)
+		n.send(pub(7, "21.5"))
+		n.expect(pub(7, "21.5"))
+		c.expect(mqttPublish, mqttPublishBody("sensors/temp", "21.5"))
+		c.send(mqttPublish, 0, mqttPublishBody("sensors/temp", "22"))
+		c.expect(mqttPublish, mqttPublishBody("sensors/temp", "22"))
+		n.expect(pub(7, "22"))
+
+		body := binary.BigEndian.AppendUint16(nil, 2)
+		c.send(mqttUnsubscribe, 0x02, appendMQTTString(body, "sensors/temp"))
+		c.expect(mqttUnsuback, []byte{0, 2})
+		n.send(pub(7, "missed"))
+		n.expect(pub(7, "missed"))
+		// subscribing again, the next publication is the first one after the SUBACK
+		if code := c.subscribe("sensors/temp"); code != 0 {
+			t.Fatalf("subscribe refused with %d", code)
+		}
+		n.send(pub(7, "back"))
+		c.expect(mqttPublish, mqttPublishBody("sensors/temp", "back"))
+	})
+}
@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// topicNames maps the names used by the MQTT and RESP listeners to topics,
+// names that aren't in the map are taken as the decimal number of the topic
+type topicNames map[string]uint16
+
+// loadTopicNames reads a file with one "name topic" entry per line
+func loadTopicNames(path string) (topicNames, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tn := make(topicNames)
+	sc := bufio.NewScanner(f)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected 2 fields, got %d", path, lineno, len(fields))
+		}
+		t, err := strconv.ParseUint(fields[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineno, err)
+		}
+		tn[fields[0]] = uint16(t)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return tn, nil
+}
+
+func (tn topicNames) topic(name string) (uint16, bool) {
+	if t, ok := tn[name]; ok {
+		return t, true
+	}
+	t, err := strconv.ParseUint(name, 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(t), true
+}
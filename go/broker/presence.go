@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"tccgo/protocol"
+)
+
+// Topics with presence enabled have a companion topic, with the presenceBit set, where
+// "join <connection id>" and "leave <connection id>" are published whenever a connection
+// subscribes to or unsubscribes from the topic. Both topics are in the same partition.
+
+const presenceBit = uint16(1 << 15)
+
+func presenceTopic(t uint16) uint16 {
+	return t | presenceBit
+}
+
+func (pc *partitionConfig) hasPresence(t uint16) bool {
+	if t&presenceBit != 0 {
+		return false
+	}
+	for _, tr := range pc.presence {
+		if tr.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPresenceTopic says whether t is the companion of a topic with presence,
+// which only the server publishes to
+func (pc *partitionConfig) isPresenceTopic(t uint16) bool {
+	return t&presenceBit != 0 && pc.hasPresence(t&^presenceBit)
+}
+
+func (sp serverPartition) announce(t uint16, event string, s subscriber) {
+	if s.peer || !sp.config.hasPresence(t) {
+		return
+	}
+	sp.handlePublish(presenceTopic(t), event+" "+strconv.FormatUint(s.id, 10), time.Time{}, false)
+}
+
+// members returns the answer to a members message: the ids of the connections subscribed to t,
+// separated by spaces
+func (sp serverPartition) members(t uint16) protocol.Msg {
+	if !sp.config.hasPresence(t) {
+		return errorMsg(t, "presence not enabled")
+	}
+	ids := make([]uint64, 0, len(sp.subscribers[t]))
+	for m := range sp.subscribers[t] {
+		if !m.peer {
+			ids = append(ids, m.id)
+		}
+	}
+	slices.Sort(ids)
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.FormatUint(id, 10)
+	}
+	return protocol.Msg{Type: protocol.MembersMsg, Topic: t, Payload: strings.Join(strs, " ")}
+}
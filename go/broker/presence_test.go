@@ -0,0 +1,46 @@
+package broker
+
+import (
+	"testing"
+
+	"tccgo/protocol"
+)
+
+func TestPresence(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, _ := startServer(t, e, func(sv *server) {
+			sv.config.presence = []TopicRange{{1, 1}}
+		})
+		pt := presenceTopic(1)
+		// connections are numbered in the order they're added
+		w := pipeTest(t, sv)
+		w.subscribe(pt)
+
+		// a peer's subscriptions are its node's, and aren't announced
+		peer := sv.conns.add("peer", make(chan zero), make(chan protocol.Msg, 1))
+		peer.peer = true
+		sv.subscribe(1, peer, true)
+		t.Cleanup(func() { sv.conns.remove(peer.id) })
+
+		a := pipeTest(t, sv)
+		a.subscribe(1)
+		w.expect(pub(pt, "join 3"))
+		b := pipeTest(t, sv)
+		b.subscribe(1)
+		w.expect(pub(pt, "join 4"))
+		a.send(protocol.Msg{Type: protocol.MembersMsg, Topic: 1})
+		a.expect(protocol.Msg{Type: protocol.MembersMsg, Topic: 1, Payload: "3 4"})
+
+		b.send(protocol.Msg{Type: protocol.UnsubMsg, Topic: 1})
+		b.expect(protocol.Msg{Type: protocol.UnsubMsg, Topic: 1})
+		w.expect(pub(pt, "leave 4"))
+
+		// only the server publishes to the companion topic
+		a.send(pub(pt, "join 5"))
+		a.expect(errorMsg(pt, "publish denied"))
+
+		sv.disconnect(peer)
+		a.conn.Close()
+		w.expect(pub(pt, "leave 3"))
+	})
+}
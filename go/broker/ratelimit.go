@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func makeTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// allow takes a token if there's one available
+func (tb *tokenBucket) allow(now time.Time) bool {
+	tb.refill(now)
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// reserve always takes a token, possibly going into debt,
+// and returns how long to wait until the debt is paid
+func (tb *tokenBucket) reserve(now time.Time) time.Duration {
+	tb.refill(now)
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// RateLimitAction is what happens to a publication that exceeds a rate limit
+type RateLimitAction uint8
+
+const (
+	RateDelay = RateLimitAction(iota)
+	RateDrop
+	RateDisconnect
+)
+
+// ParseRateLimitAction parses "delay", "drop" or "disconnect"
+func ParseRateLimitAction(s string) (RateLimitAction, error) {
+	switch s {
+	case "delay":
+		return RateDelay, nil
+	case "drop":
+		return RateDrop, nil
+	case "disconnect":
+		return RateDisconnect, nil
+	default:
+		return 0, fmt.Errorf("unknown rate limit action %q", s)
+	}
+}
+
+// RateLimitConfig limits publications per connection and per topic.
+// A zero rate disables the corresponding limit.
+type RateLimitConfig struct {
+	ConnRate   float64
+	ConnBurst  float64
+	TopicRate  float64
+	TopicBurst float64
+	Action     RateLimitAction
+}
+
+func (c RateLimitConfig) enabled() bool {
+	return c.ConnRate > 0 || c.TopicRate > 0
+}
+
+// check rejects a burst below 1 for an enabled limit, since the bucket would never hold a whole token
+func (c RateLimitConfig) check() error {
+	if c.ConnRate > 0 && c.ConnBurst < 1 {
+		return fmt.Errorf("per-connection burst %v must be at least 1", c.ConnBurst)
+	}
+	if c.TopicRate > 0 && c.TopicBurst < 1 {
+		return fmt.Errorf("per-topic burst %v must be at least 1", c.TopicBurst)
+	}
+	return nil
+}
+
+type rateLimiter struct {
+	config RateLimitConfig
+
+	mu     sync.Mutex
+	topics map[uint16]*tokenBucket
+}
+
+func makeRateLimiter(config RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		config: config,
+		topics: make(map[uint16]*tokenBucket),
+	}
+}
+
+// connLimit holds the per-connection bucket, it's only used by the connection's reading goroutine
+type connLimit struct {
+	rl   *rateLimiter
+	conn *tokenBucket // nil if there's no per-connection limit
+}
+
+func (rl *rateLimiter) forConn() connLimit {
+	cl := connLimit{rl: rl}
+	if rl.config.ConnRate > 0 {
+		cl.conn = makeTokenBucket(rl.config.ConnRate, rl.config.ConnBurst)
+	}
+	return cl
+}
+
+func (rl *rateLimiter) topicBucket(t uint16) *tokenBucket {
+	tb, ok := rl.topics[t]
+	if !ok {
+		tb = makeTokenBucket(rl.config.TopicRate, rl.config.TopicBurst)
+		rl.topics[t] = tb
+	}
+	return tb
+}
+
+type rateViolation uint8
+
+const (
+	noViolation = rateViolation(iota)
+	connViolation
+	topicViolation
+)
+
+// check says whether a publication on topic t is within the limits.
+// With the delay action, it sleeps until it is, and only reports the violation.
+func (cl connLimit) check(t uint16, st *serverStats) rateViolation {
+	rl := cl.rl
+	now := time.Now()
+	v := noViolation
+
+	if rl.config.Action == RateDelay {
+		var wait time.Duration
+		if cl.conn != nil {
+			if wait = cl.conn.reserve(now); wait > 0 {
+				v = connViolation
+			}
+		}
+		if rl.config.TopicRate > 0 {
+			rl.mu.Lock()
+			twait := rl.topicBucket(t).reserve(now)
+			rl.mu.Unlock()
+			if twait > wait {
+				wait = twait
+				v = topicViolation
+			}
+		}
+		if v != noViolation {
+			st.rateLimited(v)
+			time.Sleep(wait)
+		}
+		return v
+	}
+
+	if cl.conn != nil && !cl.conn.allow(now) {
+		v = connViolation
+	} else if rl.config.TopicRate > 0 {
+		rl.mu.Lock()
+		ok := rl.topicBucket(t).allow(now)
+		rl.mu.Unlock()
+		if !ok {
+			v = topicViolation
+		}
+	}
+	if v != noViolation {
+		st.rateLimited(v)
+	}
+	return v
+}
@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"tccgo/protocol"
+)
+
+// Requests are routed to the subscribers of a topic, and replies back to the connection that
+// made the request, see the payloads in protocol. Only the connections a request was delivered to
+// can reply to it.
+// Requests aren't forwarded to peers, since replies can only be routed to local connections.
+
+const (
+	defaultRequestTimeout = 10 * time.Second
+	maxRequestTimeout     = 5 * time.Minute
+)
+
+type requestKey struct {
+	inbox uint64
+	corr  uint32
+}
+
+type pendingRequest struct {
+	s          subscriber
+	topic      uint16
+	responders *responderSet
+	timer      *time.Timer
+}
+
+// responderSet holds the ids of the connections a request was delivered to,
+// the partitions add them before sending it
+type responderSet struct {
+	mu  sync.Mutex
+	ids map[uint64]zero
+}
+
+func makeResponderSet() *responderSet {
+	return &responderSet{ids: make(map[uint64]zero)}
+}
+
+// add does nothing on a nil set, for publications
+func (rs *responderSet) add(id uint64) {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.ids[id] = zero{}
+}
+
+func (rs *responderSet) has(id uint64) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	_, ok := rs.ids[id]
+	return ok
+}
+
+type requestTable struct {
+	mu      sync.Mutex
+	pending map[requestKey]pendingRequest
+}
+
+func makeRequestTable() *requestTable {
+	return &requestTable{
+		pending: make(map[requestKey]pendingRequest),
+	}
+}
+
+// add registers a request, which fails with a timeout error if it isn't taken in time
+func (rt *requestTable) add(s subscriber, t uint16, corr uint32, rs *responderSet, timeout time.Duration) bool {
+	k := requestKey{s.id, corr}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if _, ok := rt.pending[k]; ok {
+		return false
+	}
+	timer := time.AfterFunc(timeout, func() {
+		if pr, ok := rt.take(k); ok {
+			pr.s.send(errorMsg(pr.topic, protocol.RequestErrorPayload(corr, "timed out")))
+		}
+	})
+	rt.pending[k] = pendingRequest{s, t, rs, timer}
+	return true
+}
+
+func (rt *requestTable) take(k requestKey) (pendingRequest, bool) {
+	return rt.takeFrom(k, nil)
+}
+
+// takeFrom takes the request if the responder is one it was delivered to, or if it's nil
+func (rt *requestTable) takeFrom(k requestKey, responder *subscriber) (pendingRequest, bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	pr, ok := rt.pending[k]
+	if !ok || (responder != nil && !pr.responders.has(responder.id)) {
+		return pendingRequest{}, false
+	}
+	pr.timer.Stop()
+	delete(rt.pending, k)
+	return pr, true
+}
+
+// request delivers a request from s to the subscribers of t
+func (sv server) request(s subscriber, t uint16, payload string) {
+	corr, timeout, data, ok := protocol.ParseRequestPayload(payload)
+	if !ok {
+		s.send(errorMsg(t, "malformed request"))
+		return
+	}
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	timeout = min(timeout, maxRequestTimeout)
+
+	rs := makeResponderSet()
+	if !sv.requests.add(s, t, corr, rs, timeout) {
+		s.send(errorMsg(t, protocol.RequestErrorPayload(corr, "is already pending")))
+		return
+	}
+
+	delivered := make(chan int, 1)
+	sv.engine.publish(publication{
+		kind:       protocol.RequestMsg,
+		topic:      t,
+		payload:    protocol.RoutedPayload(s.id, corr, data),
+		delivered:  delivered,
+		responders: rs,
+	})
+	if <-delivered == 0 {
+		if _, ok := sv.requests.take(requestKey{s.id, corr}); ok {
+			s.send(errorMsg(t, protocol.RequestErrorPayload(corr, "has no responders")))
+		}
+	}
+}
+
+// reply routes a reply from s to the connection that made the request.
+// Late replies, and replies from connections the request wasn't delivered to, are dropped.
+func (sv server) reply(s subscriber, payload string) {
+	inbox, corr, data, ok := protocol.ParseRoutedPayload(payload)
+	if !ok {
+		return
+	}
+	pr, ok := sv.requests.takeFrom(requestKey{inbox, corr}, &s)
+	if !ok {
+		return
+	}
+	pr.s.send(protocol.Msg{Type: protocol.ReplyMsg, Topic: pr.topic, Payload: protocol.ReplyPayload(corr, data)})
+}
@@ -0,0 +1,444 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tccgo/protocol"
+)
+
+// Enough of RESP2 for redis pub/sub clients: SUBSCRIBE, UNSUBSCRIBE, PUBLISH, PING, AUTH and QUIT.
+// Channels are mapped to topics with topicNames.
+
+var (
+	errRESPProtocol = errors.New("resp protocol error")
+	errRESPTooLarge = errors.New("resp command too large")
+)
+
+const (
+	respMaxArgs = 16
+	respMaxBulk = protocol.MaxPayload // so a published payload fits in a message
+)
+
+// readRESPCommand reads either an array of bulk strings or an inline command
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, errRESPProtocol
+	}
+	if n > respMaxArgs {
+		return nil, errRESPTooLarge
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRESPProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errRESPProtocol
+		}
+		if size > respMaxBulk {
+			return nil, errRESPTooLarge
+		}
+		bs := make([]byte, size+2)
+		if _, err := io.ReadFull(r, bs); err != nil {
+			return nil, err
+		}
+		if string(bs[size:]) != "\r\n" {
+			return nil, errRESPProtocol
+		}
+		args[i] = string(bs[:size])
+	}
+	return args, nil
+}
+
+// readRESPLine reads a line that fits in r's buffer
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errRESPTooLarge
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func appendRESPBulk(bs []byte, s string) []byte {
+	bs = append(bs, '$')
+	bs = strconv.AppendInt(bs, int64(len(s)), 10)
+	bs = append(bs, "\r\n"...)
+	bs = append(bs, s...)
+	return append(bs, "\r\n"...)
+}
+
+func appendRESPInt(bs []byte, n int) []byte {
+	bs = append(bs, ':')
+	bs = strconv.AppendInt(bs, int64(n), 10)
+	return append(bs, "\r\n"...)
+}
+
+func appendRESPArray(bs []byte, n int) []byte {
+	bs = append(bs, '*')
+	bs = strconv.AppendInt(bs, int64(n), 10)
+	return append(bs, "\r\n"...)
+}
+
+func appendRESPError(bs []byte, e string) []byte {
+	return append(bs, "-"+e+"\r\n"...)
+}
+
+// the reply to subscribe and unsubscribe, for each channel
+func appendRESPSubscription(bs []byte, kind string, channel string, count int) []byte {
+	bs = appendRESPArray(bs, 3)
+	bs = appendRESPBulk(bs, kind)
+	if channel == "" {
+		bs = append(bs, "$-1\r\n"...)
+	} else {
+		bs = appendRESPBulk(bs, channel)
+	}
+	return appendRESPInt(bs, count)
+}
+
+func serveRESP(l net.Listener, sv server, tn topicNames) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			sv.log.Error("failed to accept connection", "proto", "resp", "err", err)
+			continue
+		}
+		go handleRESPConn(conn, sv, tn)
+	}
+}
+
+type respConn struct {
+	conn net.Conn
+	sv   server
+	log  *slog.Logger
+
+	mu         sync.Mutex
+	names      map[uint16]string // channel each topic was subscribed with
+	subscribed map[uint16]zero   // as acknowledged by the partitions
+}
+
+func (rc *respConn) write(bs []byte) error {
+	if err := rc.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	_, err := rc.conn.Write(bs)
+	return err
+}
+
+func handleRESPConn(conn net.Conn, sv server, tn topicNames) {
+	ip := remoteIP(conn.RemoteAddr())
+	if k := sv.limits.acquire(ip); k != limitNone {
+		conn.Write(appendRESPError(nil, "ERR "+k.message()))
+		conn.Close()
+		return
+	}
+	defer sv.limits.release(ip)
+
+	ctx, cancel := context.WithCancel(sv.ctx)
+	defer cancel()
+
+	msgs := make(chan protocol.Msg, 1)
+	s := sv.conns.add(conn.RemoteAddr().String(), ctx.Done(), msgs)
+	id := s.id
+	rc := &respConn{
+		conn:       conn,
+		sv:         sv,
+		log:        sv.log.With("proto", "resp", "conn", id, "remote", conn.RemoteAddr().String()),
+		names:      make(map[uint16]string),
+		subscribed: make(map[uint16]zero),
+	}
+	rc.log.Debug("connection opened")
+	sv.stats.accepted.Add(1)
+
+	context.AfterFunc(ctx, func() {
+		if err := conn.Close(); err != nil {
+			rc.log.Warn("failed to close connection", "err", err)
+		}
+		sv.disconnect(s)
+		sv.conns.remove(id)
+		sv.stats.closed.Add(1)
+		rc.log.Debug("connection closed")
+	})
+
+	go rc.writeMessages(ctx.Done(), msgs, s.backlog)
+
+	authenticated := sv.auth == nil
+	username := ""
+
+	var limit connLimit
+	if sv.rate != nil {
+		limit = sv.rate.forConn()
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(sv.keepalive.Idle)); err != nil {
+			return
+		}
+		args, err := readRESPCommand(r)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				sv.stats.readTimeouts.Add(1)
+			}
+			if err == errRESPTooLarge {
+				// what's left of the command can't be skipped safely
+				rc.write(appendRESPError(nil, "ERR "+err.Error()))
+			}
+			if err != io.EOF {
+				rc.log.Info("failed to read command", "err", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		var reply []byte
+		cmd, args := strings.ToUpper(args[0]), args[1:]
+		switch {
+		case cmd == "QUIT":
+			rc.write([]byte("+OK\r\n"))
+			return
+		case cmd == "AUTH":
+			reply, username, authenticated = rc.auth(args, username, authenticated)
+			if username != "" {
+				sv.conns.identify(id, username)
+			}
+		case !authenticated:
+			reply = appendRESPError(nil, "NOAUTH Authentication required.")
+		case cmd == "PING":
+			reply = rc.ping(args)
+		case cmd == "PUBLISH":
+			if len(args) != 2 {
+				reply = appendRESPError(nil, "ERR wrong number of arguments for 'publish' command")
+				break
+			}
+			var disconnect bool
+			reply, disconnect = rc.publish(args[0], args[1], username, limit, tn)
+			if disconnect {
+				rc.write(reply)
+				return
+			}
+		case cmd == "SUBSCRIBE":
+			if len(args) == 0 {
+				reply = appendRESPError(nil, "ERR wrong number of arguments for 'subscribe' command")
+				break
+			}
+			reply = rc.subscribe(args, s, username, tn)
+		case cmd == "UNSUBSCRIBE":
+			reply = rc.unsubscribe(args, s, tn)
+		default:
+			reply = appendRESPError(nil, fmt.Sprintf("ERR unknown command '%s'", cmd))
+		}
+		if len(reply) > 0 {
+			if err := rc.write(reply); err != nil {
+				rc.log.Info("failed to write reply", "err", err)
+				return
+			}
+		}
+	}
+}
+
+func (rc *respConn) auth(args []string, username string, authenticated bool) ([]byte, string, bool) {
+	var user, password string
+	switch len(args) {
+	case 1:
+		user, password = "default", args[0]
+	case 2:
+		user, password = args[0], args[1]
+	default:
+		return appendRESPError(nil, "ERR wrong number of arguments for 'auth' command"), username, authenticated
+	}
+	if rc.sv.auth == nil {
+		// the name can't be checked, so it's anonymous to the acl
+		return []byte("+OK\r\n"), "", true
+	}
+	if err := rc.sv.auth.Authenticate(user, password); err != nil {
+		if err != errBadCredentials {
+			rc.log.Warn("failed to authenticate", "user", user, "err", err)
+		}
+		return appendRESPError(nil, "WRONGPASS invalid username-password pair"), username, authenticated
+	}
+	return []byte("+OK\r\n"), user, true
+}
+
+func (rc *respConn) ping(args []string) []byte {
+	rc.mu.Lock()
+	subscribed := len(rc.subscribed) > 0
+	rc.mu.Unlock()
+
+	rc.sv.stats.received(protocol.PingMsg)
+	if subscribed {
+		bs := appendRESPArray(nil, 2)
+		bs = appendRESPBulk(bs, "pong")
+		if len(args) > 0 {
+			return appendRESPBulk(bs, args[0])
+		}
+		return appendRESPBulk(bs, "")
+	}
+	if len(args) > 0 {
+		return appendRESPBulk(nil, args[0])
+	}
+	return []byte("+PONG\r\n")
+}
+
+func (rc *respConn) publish(channel, payload string, username string, limit connLimit, tn topicNames) ([]byte, bool) {
+	sv := rc.sv
+	sv.stats.received(protocol.PubMsg)
+	t, ok := tn.topic(channel)
+	if !ok {
+		return appendRESPError(nil, "ERR unknown channel"), false
+	}
+	if sv.config.isPresenceTopic(t) || (sv.acl != nil && !sv.acl.allowed(username, aclPub, t)) {
+		return appendRESPError(nil, "NOPERM publish denied"), false
+	}
+	if sv.rate != nil && limit.check(t, sv.stats) != noViolation {
+		switch sv.rate.config.Action {
+		case RateDrop:
+			return appendRESPError(nil, "ERR rate limited"), false
+		case RateDisconnect:
+			return appendRESPError(nil, "ERR rate limited"), true
+		}
+	}
+	return appendRESPInt(nil, sv.publishCounted(t, payload)), false
+}
+
+// the confirmations are sent by writeMessages, when the partitions acknowledge the subscriptions
+func (rc *respConn) subscribe(channels []string, s subscriber, username string, tn topicNames) []byte {
+	var reply []byte
+	for _, channel := range channels {
+		t, ok := tn.topic(channel)
+		if !ok {
+			reply = appendRESPError(reply, "ERR unknown channel '"+channel+"'")
+			continue
+		}
+		if rc.sv.acl != nil && !rc.sv.acl.allowed(username, aclSub, t) {
+			reply = appendRESPError(reply, "NOPERM subscribe denied for '"+channel+"'")
+			continue
+		}
+		rc.mu.Lock()
+		rc.names[t] = channel
+		rc.mu.Unlock()
+		rc.sv.stats.received(protocol.SubMsg)
+		rc.sv.subscribe(t, s, true)
+	}
+	return reply
+}
+
+func (rc *respConn) unsubscribe(channels []string, s subscriber, tn topicNames) []byte {
+	var topics []uint16
+	if len(channels) == 0 {
+		rc.mu.Lock()
+		for t := range rc.subscribed {
+			topics = append(topics, t)
+		}
+		rc.mu.Unlock()
+		if len(topics) == 0 {
+			return appendRESPSubscription(nil, "unsubscribe", "", 0)
+		}
+		slices.Sort(topics)
+	}
+
+	var reply []byte
+	for _, channel := range channels {
+		t, ok := tn.topic(channel)
+		if !ok {
+			reply = appendRESPError(reply, "ERR unknown channel '"+channel+"'")
+			continue
+		}
+		rc.mu.Lock()
+		rc.names[t] = channel
+		rc.mu.Unlock()
+		topics = append(topics, t)
+	}
+	for _, t := range topics {
+		rc.sv.stats.received(protocol.UnsubMsg)
+		rc.sv.subscribe(t, s, false)
+	}
+	return reply
+}
+
+func (rc *respConn) channel(t uint16) string {
+	if name, ok := rc.names[t]; ok {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+func (rc *respConn) writeMessages(done <-chan zero, msgs <-chan protocol.Msg, backlog *atomic.Int32) {
+	for {
+		backlog.Store(0)
+		select {
+		case <-done:
+			return
+		case m := <-msgs:
+			backlog.Store(1)
+			if m.Expired(time.Now()) {
+				rc.sv.stats.expired.Add(1)
+				continue
+			}
+			var bs []byte
+			rc.mu.Lock()
+			switch m.Type {
+			case protocol.SubMsg:
+				rc.subscribed[m.Topic] = zero{}
+				bs = appendRESPSubscription(nil, "subscribe", rc.channel(m.Topic), len(rc.subscribed))
+			case protocol.UnsubMsg:
+				delete(rc.subscribed, m.Topic)
+				bs = appendRESPSubscription(nil, "unsubscribe", rc.channel(m.Topic), len(rc.subscribed))
+				delete(rc.names, m.Topic)
+			case protocol.ErrMsg:
+				bs = appendRESPError(nil, "ERR "+m.Payload+" for '"+rc.channel(m.Topic)+"'")
+			case protocol.PubMsg:
+				bs = appendRESPArray(nil, 3)
+				bs = appendRESPBulk(bs, "message")
+				bs = appendRESPBulk(bs, rc.channel(m.Topic))
+				bs = appendRESPBulk(bs, m.Payload)
+			}
+			rc.mu.Unlock()
+			if bs == nil {
+				continue
+			}
+			start := time.Now()
+			if err := rc.write(bs); err != nil {
+				rc.log.Info("failed to write to the connection", "err", err)
+				rc.conn.Close()
+				return
+			}
+			rc.sv.stats.writeLatency.since(start)
+			rc.sv.stats.sent(m.Type)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRESPCommand(t *testing.T) {
+	big := strings.Repeat("x", respMaxBulk)
+	cases := []struct {
+		in   string
+		args []string
+		err  error
+	}{
+		{"*3\r\n$7\r\nPUBLISH\r\n$1\r\na\r\n$2\r\nhi\r\n", []string{"PUBLISH", "a", "hi"}, nil},
+		{"PING hello\r\n", []string{"PING", "hello"}, nil},
+		{"*3\r\n$7\r\nPUBLISH\r\n$1\r\na\r\n$" + strconv.Itoa(len(big)) + "\r\n" + big + "\r\n", []string{"PUBLISH", "a", big}, nil},
+		{"*3\r\n$7\r\nPUBLISH\r\n$1\r\na\r\n$" + strconv.Itoa(len(big)+1) + "\r\n" + big + "x\r\n", nil, errRESPTooLarge},
+		{"*1000000000\r\n", nil, errRESPTooLarge},
+		{"*1\r\n$-1\r\n", nil, errRESPProtocol},
+		{strings.Repeat("PING ", 1000) + "\r\n", nil, errRESPTooLarge},
+	}
+	for _, c := range cases {
+		args, err := readRESPCommand(bufio.NewReader(strings.NewReader(c.in)))
+		if err != c.err || !slices.Equal(args, c.args) {
+			t.Errorf("%.40q: got %d args, %v, wanted %d args, %v", c.in, len(args), err, len(c.args), c.err)
+		}
+	}
+}
+
+// respTestConn is a RESP connection served through a pipe
+type respTestConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func respTest(t *testing.T, sv server, tn topicNames) respTestConn {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan zero)
+	go func() {
+		defer close(done)
+		handleRESPConn(server, sv, tn)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return respTestConn{t, client, bufio.NewReader(client)}
+}
+
+func (rt respTestConn) send(cmd string) {
+	rt.t.Helper()
+	rt.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := rt.conn.Write([]byte(cmd)); err != nil {
+		rt.t.Fatal(err)
+	}
+}
+
+// expect reads as much as want and compares it
+func (rt respTestConn) expect(want string) {
+	rt.t.Helper()
+	rt.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	bs := make([]byte, len(want))
+	if n, err := io.ReadFull(rt.r, bs); err != nil {
+		rt.t.Fatalf("expected %q, got %q: %v", want, bs[:n], err)
+	}
+	if string(bs) != want {
+		rt.t.Fatalf("expected %q, got %q", want, bs)
+	}
+}
+
+func (rt respTestConn) command(cmd string, reply string) {
+	rt.t.Helper()
+	rt.send(cmd)
+	rt.expect(reply)
+}
+
+func TestRESPPresenceDenied(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, _ := startServer(t, e, func(sv *server) {
+			sv.config.presence = []TopicRange{{1, 1}}
+		})
+		c := respTest(t, sv, nil)
+		c.command("PUBLISH "+strconv.Itoa(int(presenceTopic(1)))+" forged\r\n", "-NOPERM publish denied\r\n")
+		c.command("PUBLISH 1 hi\r\n", ":0\r\n")
+	})
+}
+
+func TestRESPEndToEnd(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		sv, _ := startServer(t, e, nil)
+		tn := topicNames{"news": 3}
+		sub, publisher := respTest(t, sv, tn), respTest(t, sv, tn)
+		sub.command("SUBSCRIBE news\r\n", "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+
+		// the reply counts the subscribers the publication was delivered to
+		publisher.command("*3\r\n$7\r\nPUBLISH\r\n$4\r\nnews\r\n$5\r\nhello\r\n", ":1\r\n")
+		sub.expect("*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n")
+		n := pipeTest(t, sv)
+		n.send(pub(3, "native"))
+		sub.expect("*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$6\r\nnative\r\n")
+
+		sub.command("UNSUBSCRIBE news\r\n", "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:0\r\n")
+		publisher.command("PUBLISH news missed\r\n", ":0\r\n")
+	})
+}
@@ -0,0 +1,568 @@
+package broker
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"tccgo/protocol"
+)
+
+type subscriber struct {
+	id    uint64
+	done  <-chan zero
+	mc    chan<- protocol.Msg
+	nsubs *atomic.Int32 // number of topics subscribed to, across all partitions
+	peer  bool          // whether this is a link to another server
+	// messages the writer took from mc but didn't write yet, it may batch them or block writing one
+	backlog *atomic.Int32
+}
+
+func makeSubscriber(id uint64, done <-chan zero, mc chan<- protocol.Msg) subscriber {
+	return subscriber{
+		id:      id,
+		done:    done,
+		mc:      mc,
+		nsubs:   new(atomic.Int32),
+		backlog: new(atomic.Int32),
+	}
+}
+
+// queued returns the number of messages sent to s that weren't written yet
+func (s subscriber) queued() int {
+	return len(s.mc) + int(s.backlog.Load())
+}
+
+// tryAddSubscription increments the subscription count if it's below max (0 means no limit)
+func (s subscriber) tryAddSubscription(max int) bool {
+	for {
+		n := s.nsubs.Load()
+		if max > 0 && int(n) >= max {
+			return false
+		}
+		if s.nsubs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (s subscriber) send(m protocol.Msg) {
+	select {
+	case <-s.done:
+	case s.mc <- m:
+	}
+}
+
+func (s subscriber) isDone() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type serverPartition struct {
+	subscribers map[uint16]map[subscriber]zero
+	topics      map[subscriber]map[uint16]zero
+	// only for the subscriptions that have a filter, see filter.go
+	filters map[uint16]map[subscriber]*contentFilter
+	// number of subscribers of each topic that aren't peers,
+	// peers are told whenever a topic goes from having none to having some and vice-versa
+	localSubs map[uint16]int
+	peers     map[subscriber]zero
+
+	groups      map[uint16]map[string]*consumerGroup
+	memberships map[subscriber]map[groupKey]zero
+
+	config *partitionConfig
+	stats  *partitionStats
+	limits *resourceLimiter
+}
+
+// partitionConfig is shared by all partitions, and must be set before they're started
+type partitionConfig struct {
+	groupStrategy GroupStrategy
+	presence      []TopicRange // topics with presence events, see presence.go
+}
+
+func makeServerPartition(config *partitionConfig, stats *partitionStats, limits *resourceLimiter) serverPartition {
+	return serverPartition{
+		subscribers: make(map[uint16]map[subscriber]zero),
+		topics:      make(map[subscriber]map[uint16]zero),
+		filters:     make(map[uint16]map[subscriber]*contentFilter),
+		localSubs:   make(map[uint16]int),
+		peers:       make(map[subscriber]zero),
+		groups:      make(map[uint16]map[string]*consumerGroup),
+		memberships: make(map[subscriber]map[groupKey]zero),
+		config:      config,
+		stats:       stats,
+		limits:      limits,
+	}
+}
+
+func (sp serverPartition) notifyPeers(m protocol.Msg) {
+	for p := range sp.peers {
+		p.send(m)
+	}
+}
+
+func (sp serverPartition) addLocal(t uint16) {
+	sp.localSubs[t]++
+	if sp.localSubs[t] == 1 {
+		sp.notifyPeers(protocol.Msg{Type: protocol.SubMsg, Topic: t})
+	}
+}
+
+func (sp serverPartition) removeLocal(t uint16) {
+	sp.localSubs[t]--
+	if sp.localSubs[t] <= 0 {
+		delete(sp.localSubs, t)
+		sp.notifyPeers(protocol.Msg{Type: protocol.UnsubMsg, Topic: t})
+	}
+}
+
+// handlePeer starts telling the peer about the topics this partition has local subscribers for
+func (sp serverPartition) handlePeer(s subscriber) {
+	sp.peers[s] = zero{}
+	for t := range sp.localSubs {
+		s.send(protocol.Msg{Type: protocol.SubMsg, Topic: t})
+	}
+}
+
+func (sp serverPartition) handleDisconnect(s subscriber) {
+	delete(sp.peers, s)
+	sp.leaveGroups(s)
+	ts, ok := sp.topics[s]
+	if !ok {
+		return
+	}
+	for t := range ts {
+		if ss, ok := sp.subscribers[t]; ok {
+			delete(ss, s)
+			if len(ss) == 0 {
+				delete(sp.subscribers, t)
+			}
+		}
+		sp.setFilter(t, s, nil)
+		if !s.peer {
+			sp.removeLocal(t)
+		}
+		sp.announce(t, "leave", s)
+	}
+	s.nsubs.Add(-int32(len(ts)))
+	delete(sp.topics, s)
+}
+
+// admit checks the subscription limits for a new subscription of s to t
+func (sp serverPartition) admit(t uint16, s subscriber) limitKind {
+	if s.peer {
+		s.nsubs.Add(1)
+		return limitNone
+	}
+	c := sp.limits.config.Load()
+	if c.MaxSubsPerTopic > 0 && len(sp.subscribers[t]) >= c.MaxSubsPerTopic {
+		return sp.limits.reject(limitSubsPerTopic)
+	}
+	if !s.tryAddSubscription(c.MaxSubsPerConn) {
+		return sp.limits.reject(limitSubsPerConn)
+	}
+	return limitNone
+}
+
+// subscribing again replaces the filter of the subscription
+func (sp serverPartition) handleSubscribe(t uint16, s subscriber, f *contentFilter) (protocol.Msg, bool) {
+	ts, ok := sp.topics[s]
+	if _, subscribed := ts[t]; !subscribed {
+		if k := sp.admit(t, s); k != limitNone {
+			return errorMsg(t, k.message()), true
+		}
+		if !ok {
+			ts = make(map[uint16]zero)
+			sp.topics[s] = ts
+		}
+		ts[t] = zero{}
+		ss, ok := sp.subscribers[t]
+		if !ok {
+			ss = make(map[subscriber]zero)
+			sp.subscribers[t] = ss
+		}
+		ss[s] = zero{}
+		if !s.peer {
+			sp.addLocal(t)
+		}
+		defer sp.announce(t, "join", s)
+	}
+	sp.setFilter(t, s, f)
+
+	// peers aren't sent acks, they would take them as a subscription of their own
+	return protocol.Msg{Type: protocol.SubMsg, Topic: t}, !s.peer
+}
+
+func (sp serverPartition) handleUnsubscribe(t uint16, s subscriber) (protocol.Msg, bool) {
+	sp.setFilter(t, s, nil)
+	ss, ok := sp.subscribers[t]
+	if ok {
+		delete(ss, s)
+		if len(ss) == 0 {
+			delete(sp.subscribers, t)
+		}
+	}
+
+	ts, ok := sp.topics[s]
+	if ok {
+		if _, subscribed := ts[t]; subscribed {
+			s.nsubs.Add(-1)
+			if !s.peer {
+				sp.removeLocal(t)
+			}
+			defer sp.announce(t, "leave", s)
+		}
+		delete(ts, t)
+		if len(ts) == 0 {
+			delete(sp.topics, s)
+		}
+	}
+
+	return protocol.Msg{Type: protocol.UnsubMsg, Topic: t}, !s.peer
+}
+
+// publications that came from a peer are only delivered to local subscribers,
+// so they're never forwarded more than once and can't loop between servers
+func (sp serverPartition) handlePublish(t uint16, p string, deadline time.Time, fromPeer bool) int {
+	return sp.deliver(protocol.Msg{Type: protocol.PubMsg, Topic: t, Payload: p, Deadline: deadline}, fromPeer, nil)
+}
+
+func (sp serverPartition) handleRequest(t uint16, p string, rs *responderSet) int {
+	return sp.deliver(protocol.Msg{Type: protocol.RequestMsg, Topic: t, Payload: p}, true, rs)
+}
+
+// deliver sends m to the subscribers of its topic, and to one member of each group.
+// The ones it's sent to are added to rs.
+func (sp serverPartition) deliver(m protocol.Msg, skipPeers bool, rs *responderSet) int {
+	ss := sp.subscribers[m.Topic]
+	fs := sp.filters[m.Topic]
+	if len(ss) > 0 || len(sp.groups[m.Topic]) > 0 {
+		// every subscriber's writer shares the same bytes
+		m = m.Encoded()
+	}
+	n := sp.publishToGroups(m, rs)
+	for s := range ss {
+		if deliverTo(s, fs[s], m, skipPeers, rs) {
+			n++
+		}
+	}
+	sp.stats.fanout.observe(float64(n))
+	return n
+}
+
+// deliverTo sends m to s, unless s is a peer that must be skipped or its filter doesn't match
+func deliverTo(s subscriber, f *contentFilter, m protocol.Msg, skipPeers bool, rs *responderSet) bool {
+	if skipPeers && s.peer {
+		return false
+	}
+	if m.Type == protocol.PubMsg && !f.match(m.Payload) {
+		return false
+	}
+	rs.add(s.id)
+	if s.peer {
+		s.send(forPeer(m, time.Now()))
+	} else {
+		s.send(m)
+	}
+	return true
+}
+
+type topicInfo struct {
+	Topic       uint16         `json:"topic"`
+	Subscribers int            `json:"subscribers"`
+	Groups      map[string]int `json:"groups,omitempty"` // group name -> number of members
+}
+
+type partitionInfo struct {
+	topics []topicInfo
+	// connection id -> topics it's subscribed to in this partition
+	subscriptions map[uint64][]uint16
+}
+
+func (sp serverPartition) info() partitionInfo {
+	pi := partitionInfo{
+		topics:        make([]topicInfo, 0, len(sp.subscribers)),
+		subscriptions: make(map[uint64][]uint16, len(sp.topics)),
+	}
+	for t, ss := range sp.subscribers {
+		pi.topics = append(pi.topics, topicInfo{Topic: t, Subscribers: len(ss)})
+	}
+	for t, groups := range sp.groups {
+		gi := make(map[string]int, len(groups))
+		for name, g := range groups {
+			gi[name] = len(g.members)
+		}
+		if i := slices.IndexFunc(pi.topics, func(ti topicInfo) bool { return ti.Topic == t }); i >= 0 {
+			pi.topics[i].Groups = gi
+		} else {
+			pi.topics = append(pi.topics, topicInfo{Topic: t, Groups: gi})
+		}
+	}
+	for s, ts := range sp.topics {
+		for t := range ts {
+			pi.subscriptions[s.id] = append(pi.subscriptions[s.id], t)
+		}
+	}
+	for s, gs := range sp.memberships {
+		for k := range gs {
+			pi.subscriptions[s.id] = append(pi.subscriptions[s.id], k.topic)
+		}
+	}
+	return pi
+}
+
+type subscriptionRequest struct {
+	topic  uint16
+	b      bool
+	s      subscriber
+	group  string // empty if not a group subscription
+	filter *contentFilter
+}
+
+// handleSubscription handles sx and answers its subscriber
+func (sp serverPartition) handleSubscription(sx subscriptionRequest) {
+	if m, ok := sp.subscription(sx); ok {
+		sx.s.send(m)
+	}
+}
+
+// subscription handles sx, and returns the ack or error to answer its subscriber with, if any
+func (sp serverPartition) subscription(sx subscriptionRequest) (protocol.Msg, bool) {
+	switch {
+	case sx.group != "" && sx.b:
+		return sp.handleGroupSubscribe(sx.topic, sx.group, sx.s)
+	case sx.group != "":
+		return sp.handleGroupUnsubscribe(sx.topic, sx.group, sx.s)
+	case sx.b:
+		return sp.handleSubscribe(sx.topic, sx.s, sx.filter)
+	default:
+		return sp.handleUnsubscribe(sx.topic, sx.s)
+	}
+}
+
+type publication struct {
+	kind     protocol.MsgType // PubMsg or RequestMsg
+	topic    uint16
+	payload  string
+	fromPeer bool
+	deadline time.Time // zero if the publication doesn't expire
+	// if not nil, receives the number of subscribers the publication was delivered to
+	delivered chan<- int
+	// of a request, gets the subscribers it's delivered to
+	responders *responderSet
+}
+
+func (px publication) expired(now time.Time) bool {
+	return !px.deadline.IsZero() && !now.Before(px.deadline)
+}
+
+// done tells the publisher how many subscribers the publication was delivered to, if it asked
+func (px publication) done(n int) {
+	if px.delivered != nil {
+		px.delivered <- n
+	}
+}
+
+const commandPrefix = "!sumall "
+
+// commands run on the server they were published to, peers only relay the results
+func (px publication) isCommand() bool {
+	return !px.fromPeer && strings.HasPrefix(px.payload, commandPrefix)
+}
+
+// runCommand returns the publication with the result, to the same topic
+func (px publication) runCommand(st *partitionStats) publication {
+	start := time.Now()
+	result := Sumall(px.payload[len(commandPrefix):])
+	st.compute.since(start)
+	return publication{kind: protocol.PubMsg, topic: px.topic, payload: result}
+}
+
+type membersRequest struct {
+	topic uint16
+	s     subscriber
+}
+
+type serverPartitionChannels struct {
+	disconnect chan subscriber
+	subscribe  chan subscriptionRequest
+	publish    chan publication
+	peer       chan subscriber
+	members    chan membersRequest
+	query      chan chan<- partitionInfo
+}
+
+func makeServerPartitionChannels() serverPartitionChannels {
+	return serverPartitionChannels{
+		disconnect: make(chan subscriber),
+		subscribe:  make(chan subscriptionRequest),
+		publish:    make(chan publication),
+		peer:       make(chan subscriber),
+		members:    make(chan membersRequest),
+		query:      make(chan chan<- partitionInfo),
+	}
+}
+
+func (spc serverPartitionChannels) main(sp serverPartition, stop <-chan zero) {
+	for {
+		select {
+		case <-stop:
+			return
+		case s := <-spc.disconnect:
+			sp.handleDisconnect(s)
+		case sx := <-spc.subscribe:
+			sp.handleSubscription(sx)
+		case s := <-spc.peer:
+			sp.handlePeer(s)
+		case mx := <-spc.members:
+			mx.s.send(sp.members(mx.topic))
+		case px := <-spc.publish:
+			switch {
+			case px.expired(time.Now()):
+				sp.stats.expired.Add(1)
+				px.done(0)
+			case px.kind == protocol.RequestMsg:
+				px.done(sp.handleRequest(px.topic, px.payload, px.responders))
+			case px.isCommand():
+				px.done(0)
+				go func() {
+					result := px.runCommand(sp.stats)
+					select {
+					case <-stop:
+					case spc.publish <- result:
+					}
+				}()
+			default:
+				px.done(sp.handlePublish(px.topic, px.payload, px.deadline, px.fromPeer))
+			}
+		case rc := <-spc.query:
+			rc <- sp.info()
+		}
+	}
+}
+
+type server struct {
+	ctx       context.Context // cancelled when the server shuts down, closing every connection
+	engine    Broker
+	conns     *connTable
+	stats     *serverStats
+	limits    *resourceLimiter
+	config    *partitionConfig
+	requests  *requestTable
+	auth      Authenticator // nil if authentication is disabled
+	acl       *aclStore     // nil if every operation is allowed
+	rate      *rateLimiter  // nil if publications aren't rate limited
+	node      string        // identifies this server to its peers
+	peers     *peerTable
+	sessions  *sessionTable // nil if sessions are disabled
+	keepalive KeepaliveConfig
+	writes    WriteBatchConfig
+	log       *slog.Logger
+}
+
+func makeServer(ctx context.Context, nparts int, engine Engine) server {
+	parts := make([]serverPartition, nparts)
+	stats := makeServerStats(nparts)
+	limits := makeResourceLimiter(LimitsConfig{})
+	config := new(partitionConfig)
+	for i := range nparts {
+		parts[i] = makeServerPartition(config, stats.parts[i], limits)
+	}
+	return server{
+		ctx:       ctx,
+		engine:    makeEngine(engine, parts, stats),
+		conns:     makeConnTable(),
+		stats:     stats,
+		limits:    limits,
+		config:    config,
+		requests:  makeRequestTable(),
+		node:      makeNodeID(),
+		peers:     makePeerTable(),
+		keepalive: defaultKeepalive,
+		writes:    defaultWriteBatch,
+		log:       slog.Default(),
+	}
+}
+
+// start runs the partitions until stop is closed, which must only happen after every connection is gone
+func (sv server) start(stop <-chan zero) {
+	sv.engine.start(stop)
+}
+
+// presence topics are in the same partition as their topic
+func partitionIndex(t uint16, nparts int) int {
+	return int(t&^presenceBit) % nparts
+}
+
+func (sv server) disconnect(s subscriber) {
+	sv.engine.disconnect(s)
+}
+
+func (sv server) subscribe(t uint16, s subscriber, b bool) {
+	sv.engine.subscribe(subscriptionRequest{topic: t, b: b, s: s})
+}
+
+func (sv server) subscribeFiltered(t uint16, s subscriber, f *contentFilter) {
+	sv.engine.subscribe(subscriptionRequest{topic: t, b: true, s: s, filter: f})
+}
+
+func (sv server) subscribeGroup(t uint16, group string, s subscriber, b bool) {
+	sv.engine.subscribe(subscriptionRequest{topic: t, b: b, s: s, group: group})
+}
+
+func (sv server) publish(t uint16, p string) {
+	sv.engine.publish(publication{kind: protocol.PubMsg, topic: t, payload: p})
+}
+
+// publishCounted publishes and waits for the number of subscribers the publication was delivered to
+func (sv server) publishCounted(t uint16, p string) int {
+	delivered := make(chan int, 1)
+	sv.engine.publish(publication{kind: protocol.PubMsg, topic: t, payload: p, delivered: delivered})
+	return <-delivered
+}
+
+// publishExpiring publishes with a deadline, after which the publication is dropped
+func (sv server) publishExpiring(t uint16, p string, deadline time.Time) {
+	sv.engine.publish(publication{kind: protocol.PubMsg, topic: t, payload: p, deadline: deadline})
+}
+
+// relay publishes a publication that came from a peer
+func (sv server) relay(t uint16, p string, deadline time.Time) {
+	sv.engine.publish(publication{kind: protocol.PubMsg, topic: t, payload: p, fromPeer: true, deadline: deadline})
+}
+
+func (sv server) members(t uint16, s subscriber) {
+	sv.engine.members(t, s)
+}
+
+func (sv server) watch(s subscriber) {
+	sv.engine.watch(s)
+}
+
+func (sv server) info() []partitionInfo {
+	return sv.engine.info()
+}
+
+// Sumall computes the result of the "!sumall <text>" command, a deliberately CPU-heavy publication
+func Sumall(s string) string {
+	bs := make([]byte, len(s))
+	for i := range bs {
+		r := byte(0)
+		for j := range s {
+			for k := range s {
+				r = byte(int64(r) + int64(s[i])*int64(j) + int64(s[k]))
+			}
+		}
+		bs[i] = (r % 26) + 'a'
+	}
+	return string(bs)
+}
@@ -0,0 +1,205 @@
+package broker
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tccgo/protocol"
+)
+
+// A session owns the subscriptions of a client instead of its connection, so they survive
+// reconnects. While no connection is attached, publications are buffered (dropping the oldest
+// when the buffer is full) and the session expires after the grace period, unsubscribing from everything.
+// Sessions aren't shared with peers: a client must reconnect to the same server to resume.
+
+func makeSessionID() string {
+	bs := make([]byte, 16)
+	if _, err := crand.Read(bs); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bs)
+}
+
+type session struct {
+	id     string
+	user   string
+	s      subscriber // what the partitions see, outlives the connections
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	out     chan<- protocol.Msg // of the attached connection, nil while detached
+	outDone <-chan zero
+	kick    context.CancelFunc // closes the attached connection
+	missed  []protocol.Msg
+	timer   *time.Timer // runs out the grace period while detached
+	expired bool
+}
+
+type sessionTable struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	grace    time.Duration
+	buffer   int
+}
+
+func makeSessionTable(grace time.Duration, buffer int) *sessionTable {
+	return &sessionTable{
+		sessions: make(map[string]*session),
+		grace:    grace,
+		buffer:   buffer,
+	}
+}
+
+// open returns the session with the id if it belongs to user, or starts a new one
+func (st *sessionTable) open(id string, user string, sv server) (*session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if ss, ok := st.sessions[id]; ok && ss.user == user {
+		// it may expire before it's attached, then the caller opens it again and gets a new one
+		return ss, true
+	}
+
+	ctx, cancel := context.WithCancel(sv.ctx)
+	mc := make(chan protocol.Msg, 1)
+	s := sv.conns.add("session", ctx.Done(), mc)
+	sv.conns.identify(s.id, user)
+	ss := &session{
+		id:     makeSessionID(),
+		user:   user,
+		s:      s,
+		cancel: cancel,
+	}
+	st.sessions[ss.id] = ss
+
+	context.AfterFunc(ctx, func() {
+		sv.disconnect(ss.s)
+		sv.conns.remove(s.id)
+		st.mu.Lock()
+		delete(st.sessions, ss.id)
+		st.mu.Unlock()
+	})
+	go ss.pump(mc, s.backlog, ctx.Done(), st.buffer, sv.stats)
+	return ss, false
+}
+
+// attach makes a connection receive the session's messages, replacing the connection attached before.
+// first is sent before the messages missed while detached.
+func (ss *session) attach(out chan<- protocol.Msg, done <-chan zero, kick context.CancelFunc, first protocol.Msg, st *serverStats) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.expired {
+		return false
+	}
+	if ss.timer != nil {
+		ss.timer.Stop()
+		ss.timer = nil
+	}
+	if ss.kick != nil {
+		ss.kick()
+	}
+	ss.out, ss.outDone, ss.kick = out, done, kick
+
+	// the pump waits for the lock, so nothing newer gets ahead of these
+	ss.prune(time.Now(), st)
+	for _, m := range append([]protocol.Msg{first}, ss.missed...) {
+		select {
+		case <-done:
+			return true
+		case out <- m:
+		}
+	}
+	ss.missed = nil
+	return true
+}
+
+// detach is called once the connection with done is gone, if it's still the attached one
+func (ss *session) detach(done <-chan zero, grace time.Duration) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.outDone != done {
+		return
+	}
+	ss.out, ss.outDone, ss.kick = nil, nil, nil
+	ss.timer = time.AfterFunc(grace, func() {
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		if ss.out == nil {
+			ss.expired = true
+			ss.cancel()
+		}
+	})
+}
+
+// pump forwards the session's messages to the attached connection, or buffers them
+func (ss *session) pump(mc <-chan protocol.Msg, backlog *atomic.Int32, done <-chan zero, buffer int, st *serverStats) {
+	for {
+		select {
+		case <-done:
+			return
+		case m := <-mc:
+			backlog.Store(1)
+			ss.forward(m, buffer, st)
+			backlog.Store(0)
+		}
+	}
+}
+
+func (ss *session) forward(m protocol.Msg, buffer int, st *serverStats) {
+	ss.mu.Lock()
+	out, outDone := ss.out, ss.outDone
+	if out == nil {
+		ss.buffer(m, buffer, st)
+		ss.mu.Unlock()
+		return
+	}
+	ss.mu.Unlock()
+
+	select {
+	case out <- m:
+	case <-outDone:
+		// the connection is going away, keep the message for the next one
+		// unless it's already attached
+		ss.mu.Lock()
+		if ss.out == nil || ss.outDone == outDone {
+			ss.buffer(m, buffer, st)
+			ss.mu.Unlock()
+			return
+		}
+		ss.mu.Unlock()
+		ss.forward(m, buffer, st)
+	}
+}
+
+// buffer keeps m while detached. Expired publications aren't kept,
+// and make room before the oldest live one is dropped.
+func (ss *session) buffer(m protocol.Msg, buffer int, st *serverStats) {
+	now := time.Now()
+	if m.Expired(now) {
+		st.expired.Add(1)
+		return
+	}
+	if len(ss.missed) >= buffer {
+		ss.prune(now, st)
+	}
+	if len(ss.missed) >= buffer {
+		ss.missed = ss.missed[1:]
+		st.sessionDrops.Add(1)
+	}
+	ss.missed = append(ss.missed, m)
+}
+
+// prune drops the missed publications that expired
+func (ss *session) prune(now time.Time, st *serverStats) {
+	ss.missed = slices.DeleteFunc(ss.missed, func(m protocol.Msg) bool {
+		if m.Expired(now) {
+			st.expired.Add(1)
+			return true
+		}
+		return false
+	})
+}
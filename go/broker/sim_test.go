@@ -0,0 +1,363 @@
+package broker
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"tccgo/protocol"
+)
+
+// The simulation drives the partition handlers from a single goroutine, with a seeded scheduler
+// choosing what happens next: a client making a request, a partition handling the oldest request
+// in its inbox (as main would receive it from a channel), or a client reading a message.
+// Time is virtual, advanced by the scheduler, and only used for the publications' deadlines.
+// A failure prints the seed, and -sim.seed replays it.
+
+var (
+	simSeed  = flag.Uint64("sim.seed", 0, "run the simulation with only this seed")
+	simRuns  = flag.Int("sim.runs", 200, "number of seeds to simulate")
+	simSteps = flag.Int("sim.steps", 2000, "number of steps of each simulation")
+)
+
+const (
+	simTopics = 6
+	simParts  = 3
+	// more than a simulation publishes, so sends never block, since nothing runs concurrently
+	simQueue = 1024
+)
+
+var (
+	simFilters = []string{"", "", "prefix a", "contains 2"}
+	simGroups  = []string{"g1", "g2"}
+	simWords   = []string{"a1", "a2", "b1", "b2"}
+)
+
+type simRequestKind uint8
+
+const (
+	simSub = simRequestKind(iota)
+	simUnsub
+	simGroupSub
+	simGroupUnsub
+	simPub
+	simDisconnect
+)
+
+type simRequest struct {
+	kind  simRequestKind
+	s     subscriber
+	topic uint16
+	arg   string // the filter, group name or payload
+	px    publication
+}
+
+// simClient checks what a connection receives against the acks it received before
+type simClient struct {
+	s         subscriber
+	mc        chan protocol.Msg
+	connected bool
+
+	pending    map[uint16][]*contentFilter // filters of subscriptions that weren't acknowledged yet
+	subscribed map[uint16]*contentFilter
+	groups     map[groupKey]zero
+}
+
+type simulation struct {
+	t       *testing.T
+	seed    uint64
+	rng     *rand.Rand
+	now     time.Time
+	parts   []serverPartition
+	inboxes [][]simRequest
+	clients []*simClient
+	nextID  uint64
+
+	delivered int // as counted by the partitions
+	received  int // publications read by the clients
+}
+
+func newSimulation(t *testing.T, seed uint64) *simulation {
+	sim := &simulation{
+		t:       t,
+		seed:    seed,
+		rng:     rand.New(rand.NewPCG(seed, 0)),
+		now:     time.Unix(0, 0),
+		inboxes: make([][]simRequest, simParts),
+	}
+	config := new(partitionConfig)
+	limits := makeResourceLimiter(LimitsConfig{})
+	for range simParts {
+		sim.parts = append(sim.parts, makeServerPartition(config, makePartitionStats(), limits))
+	}
+	return sim
+}
+
+func (sim *simulation) fail(f string, a ...any) {
+	sim.t.Helper()
+	sim.t.Fatalf("seed %d: %s", sim.seed, fmt.Sprintf(f, a...))
+}
+
+func (sim *simulation) connect() {
+	sim.nextID++
+	mc := make(chan protocol.Msg, simQueue)
+	// done is never closed, so every send lands in mc and can be checked
+	sim.clients = append(sim.clients, &simClient{
+		s:          makeSubscriber(sim.nextID, make(chan zero), mc),
+		mc:         mc,
+		connected:  true,
+		pending:    make(map[uint16][]*contentFilter),
+		subscribed: make(map[uint16]*contentFilter),
+		groups:     make(map[groupKey]zero),
+	})
+}
+
+func (sim *simulation) enqueue(r simRequest) {
+	i := partitionIndex(r.topic, simParts)
+	sim.inboxes[i] = append(sim.inboxes[i], r)
+}
+
+// request makes a random client do something, or connects a new one
+func (sim *simulation) request() {
+	var connected []*simClient
+	for _, c := range sim.clients {
+		if c.connected {
+			connected = append(connected, c)
+		}
+	}
+	if len(connected) == 0 || sim.rng.IntN(20) == 0 {
+		sim.connect()
+		return
+	}
+	c := connected[sim.rng.IntN(len(connected))]
+	t := uint16(sim.rng.IntN(simTopics))
+	switch k := sim.rng.IntN(10); {
+	case k < 3:
+		f := simFilters[sim.rng.IntN(len(simFilters))]
+		pf, err := parseFilter(f)
+		if err != nil {
+			sim.fail("bad filter %q: %v", f, err)
+		}
+		c.pending[t] = append(c.pending[t], pf)
+		sim.enqueue(simRequest{kind: simSub, s: c.s, topic: t, arg: f})
+	case k < 4:
+		sim.enqueue(simRequest{kind: simUnsub, s: c.s, topic: t})
+	case k == 4:
+		sim.enqueue(simRequest{kind: simGroupSub, s: c.s, topic: t, arg: simGroups[sim.rng.IntN(len(simGroups))]})
+	case k == 5:
+		sim.enqueue(simRequest{kind: simGroupUnsub, s: c.s, topic: t, arg: simGroups[sim.rng.IntN(len(simGroups))]})
+	case k < 9:
+		px := publication{kind: protocol.PubMsg, topic: t, payload: simWords[sim.rng.IntN(len(simWords))]}
+		if sim.rng.IntN(4) == 0 {
+			px.deadline = sim.now.Add(time.Duration(sim.rng.IntN(20)) * time.Millisecond)
+		}
+		sim.enqueue(simRequest{kind: simPub, topic: t, px: px})
+	default:
+		// like serveConn, which disconnects from every partition once it's done
+		c.connected = false
+		for i := range sim.inboxes {
+			sim.inboxes[i] = append(sim.inboxes[i], simRequest{kind: simDisconnect, s: c.s})
+		}
+	}
+}
+
+// handle makes partition i handle its oldest request, and reports whether it had any
+func (sim *simulation) handle(i int) bool {
+	if len(sim.inboxes[i]) == 0 {
+		return false
+	}
+	r := sim.inboxes[i][0]
+	sim.inboxes[i] = sim.inboxes[i][1:]
+	sp := sim.parts[i]
+	switch r.kind {
+	case simSub:
+		f, _ := parseFilter(r.arg)
+		sp.handleSubscription(subscriptionRequest{topic: r.topic, b: true, s: r.s, filter: f})
+	case simUnsub:
+		sp.handleSubscription(subscriptionRequest{topic: r.topic, b: false, s: r.s})
+	case simGroupSub:
+		sp.handleSubscription(subscriptionRequest{topic: r.topic, b: true, s: r.s, group: r.arg})
+	case simGroupUnsub:
+		sp.handleSubscription(subscriptionRequest{topic: r.topic, b: false, s: r.s, group: r.arg})
+	case simPub:
+		if !r.px.expired(sim.now) {
+			sim.delivered += sp.handlePublish(r.px.topic, r.px.payload, r.px.deadline, false)
+		}
+	case simDisconnect:
+		sp.handleDisconnect(r.s)
+	}
+	sim.checkPartition(sp)
+	sim.checkCounts()
+	return true
+}
+
+// read makes a client read one message, and reports whether it had any
+func (sim *simulation) read(c *simClient) bool {
+	var m protocol.Msg
+	select {
+	case m = <-c.mc:
+	default:
+		return false
+	}
+	switch m.Type {
+	case protocol.SubMsg:
+		fs := c.pending[m.Topic]
+		if len(fs) == 0 {
+			sim.fail("conn %d: unexpected ack %v", c.s.id, m)
+		}
+		c.subscribed[m.Topic] = fs[0]
+		c.pending[m.Topic] = fs[1:]
+	case protocol.UnsubMsg:
+		delete(c.subscribed, m.Topic)
+	case protocol.GroupSubMsg:
+		c.groups[groupKey{m.Topic, m.Payload}] = zero{}
+	case protocol.GroupUnsubMsg:
+		delete(c.groups, groupKey{m.Topic, m.Payload})
+	case protocol.PubMsg:
+		sim.received++
+		if m.Expired(sim.now) {
+			// it would be dropped by the writer, but it was delivered in time
+			break
+		}
+		if f, ok := c.subscribed[m.Topic]; ok && f.match(m.Payload) {
+			break
+		}
+		for k := range c.groups {
+			if k.topic == m.Topic {
+				return true
+			}
+		}
+		sim.fail("conn %d: got %v without being subscribed (subscriptions %v, groups %v)", c.s.id, m, c.subscribed, c.groups)
+	default:
+		sim.fail("conn %d: unexpected %v", c.s.id, m)
+	}
+	return true
+}
+
+// checkPartition checks that the partition's indexes agree with each other
+func (sim *simulation) checkPartition(sp serverPartition) {
+	sim.t.Helper()
+	for t, ss := range sp.subscribers {
+		if len(ss) == 0 {
+			sim.fail("topic %d has an empty subscriber set", t)
+		}
+		for s := range ss {
+			if _, ok := sp.topics[s][t]; !ok {
+				sim.fail("conn %d subscribed to %d, but it's not in its topics", s.id, t)
+			}
+		}
+	}
+	for s, ts := range sp.topics {
+		if len(ts) == 0 {
+			sim.fail("conn %d has an empty topic set", s.id)
+		}
+		for t := range ts {
+			if _, ok := sp.subscribers[t][s]; !ok {
+				sim.fail("conn %d has topic %d, but isn't one of its subscribers", s.id, t)
+			}
+		}
+	}
+	for t, fs := range sp.filters {
+		for s := range fs {
+			if _, ok := sp.subscribers[t][s]; !ok {
+				sim.fail("conn %d has a filter for %d without being subscribed", s.id, t)
+			}
+		}
+	}
+	local := make(map[uint16]int)
+	for t, ss := range sp.subscribers {
+		local[t] += len(ss)
+	}
+	for t, groups := range sp.groups {
+		for name, g := range groups {
+			if len(g.members) == 0 {
+				sim.fail("group %s of %d is empty", name, t)
+			}
+			local[t] += len(g.members)
+			for _, s := range g.members {
+				if _, ok := sp.memberships[s][groupKey{t, name}]; !ok {
+					sim.fail("conn %d is in group %s of %d, but not in its memberships", s.id, name, t)
+				}
+			}
+		}
+	}
+	for t, n := range local {
+		if sp.localSubs[t] != n {
+			sim.fail("topic %d has %d local subscribers, counted %d", t, n, sp.localSubs[t])
+		}
+	}
+	if len(sp.localSubs) != len(local) {
+		sim.fail("local subscriber counts %v, expected %v", sp.localSubs, local)
+	}
+}
+
+// checkCounts checks each connection's subscription count against the partitions
+func (sim *simulation) checkCounts() {
+	sim.t.Helper()
+	for _, c := range sim.clients {
+		n := 0
+		for _, sp := range sim.parts {
+			n += len(sp.topics[c.s]) + len(sp.memberships[c.s])
+		}
+		if int(c.s.nsubs.Load()) != n {
+			sim.fail("conn %d counts %d subscriptions, the partitions have %d", c.s.id, c.s.nsubs.Load(), n)
+		}
+	}
+}
+
+func (sim *simulation) step() {
+	sim.now = sim.now.Add(time.Duration(sim.rng.IntN(5)) * time.Millisecond)
+	switch k := sim.rng.IntN(3); {
+	case k == 0:
+		sim.request()
+	case k == 1:
+		sim.handle(sim.rng.IntN(simParts))
+	case len(sim.clients) > 0:
+		sim.read(sim.clients[sim.rng.IntN(len(sim.clients))])
+	}
+}
+
+// finish handles every request and reads every message, and checks nothing was lost
+func (sim *simulation) finish() {
+	for i := range sim.inboxes {
+		for sim.handle(i) {
+		}
+	}
+	for _, c := range sim.clients {
+		for sim.read(c) {
+		}
+		if c.connected {
+			continue
+		}
+		for _, sp := range sim.parts {
+			if _, ok := sp.topics[c.s]; ok {
+				sim.fail("conn %d still has topics after disconnecting", c.s.id)
+			}
+			if _, ok := sp.memberships[c.s]; ok {
+				sim.fail("conn %d is still in groups after disconnecting", c.s.id)
+			}
+		}
+	}
+	if sim.delivered != sim.received {
+		sim.fail("partitions delivered %d publications, clients received %d", sim.delivered, sim.received)
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	seeds := make([]uint64, *simRuns)
+	for i := range seeds {
+		seeds[i] = uint64(i + 1)
+	}
+	if *simSeed != 0 {
+		seeds = []uint64{*simSeed}
+	}
+	for _, seed := range seeds {
+		sim := newSimulation(t, seed)
+		for range *simSteps {
+			sim.step()
+		}
+		sim.finish()
+	}
+}
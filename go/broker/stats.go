@@ -0,0 +1,148 @@
+package broker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tccgo/protocol"
+)
+
+type serverStats struct {
+	accepted     atomic.Int64
+	closed       atomic.Int64
+	readTimeouts atomic.Int64
+	connLimited  atomic.Int64
+	topicLimited atomic.Int64
+	expired      atomic.Int64 // dropped before being written, see also partitionStats
+	resumed      atomic.Int64 // sessions resumed by a new connection
+	sessionDrops atomic.Int64 // publications dropped from a full session buffer
+	writes       atomic.Int64 // to connections, each with a batch of messages
+	msgsIn       [256]atomic.Int64
+	msgsOut      [256]atomic.Int64
+	writeLatency *histogram
+	parts        []*partitionStats
+}
+
+func makeServerStats(nparts int) *serverStats {
+	parts := make([]*partitionStats, nparts)
+	for i := range parts {
+		parts[i] = makePartitionStats()
+	}
+	return &serverStats{
+		writeLatency: makeHistogram(latencyBuckets),
+		parts:        parts,
+	}
+}
+
+func (st *serverStats) received(t protocol.MsgType) {
+	st.msgsIn[t].Add(1)
+}
+
+func (st *serverStats) sent(t protocol.MsgType) {
+	st.msgsOut[t].Add(1)
+}
+
+func (st *serverStats) rateLimited(v rateViolation) {
+	switch v {
+	case connViolation:
+		st.connLimited.Add(1)
+	case topicViolation:
+		st.topicLimited.Add(1)
+	}
+}
+
+func (st *serverStats) connections() int64 {
+	return st.accepted.Load() - st.closed.Load()
+}
+
+// counts by type name, only the types that were seen at least once
+func countsByType(cs *[256]atomic.Int64) map[string]int64 {
+	r := make(map[string]int64)
+	for t := range cs {
+		if n := cs[t].Load(); n > 0 {
+			r[protocol.MsgType(t).Name()] = n
+		}
+	}
+	return r
+}
+
+type connInfo struct {
+	id    uint64
+	addr  string
+	user  string
+	since time.Time
+	s     subscriber
+}
+
+type connTable struct {
+	mu      sync.Mutex
+	next    uint64
+	conns   map[uint64]connInfo
+	waiters []chan zero // closed when the table becomes empty
+}
+
+func makeConnTable() *connTable {
+	return &connTable{
+		conns: make(map[uint64]connInfo),
+	}
+}
+
+// add adds a connection that receives messages in mc, and returns its subscriber
+func (ct *connTable) add(addr string, done <-chan zero, mc chan<- protocol.Msg) subscriber {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.next++
+	s := makeSubscriber(ct.next, done, mc)
+	ct.conns[s.id] = connInfo{
+		id:    s.id,
+		addr:  addr,
+		since: time.Now(),
+		s:     s,
+	}
+	return s
+}
+
+func (ct *connTable) identify(id uint64, user string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ci, ok := ct.conns[id]; ok {
+		ci.user = user
+		ct.conns[id] = ci
+	}
+}
+
+func (ct *connTable) remove(id uint64) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	delete(ct.conns, id)
+	if len(ct.conns) == 0 {
+		for _, w := range ct.waiters {
+			close(w)
+		}
+		ct.waiters = nil
+	}
+}
+
+// empty returns a channel that's closed once there are no connections
+func (ct *connTable) empty() <-chan zero {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	w := make(chan zero)
+	if len(ct.conns) == 0 {
+		close(w)
+	} else {
+		ct.waiters = append(ct.waiters, w)
+	}
+	return w
+}
+
+func (ct *connTable) list() []connInfo {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	r := make([]connInfo, 0, len(ct.conns))
+	for _, ci := range ct.conns {
+		r = append(r, ci)
+	}
+	return r
+}
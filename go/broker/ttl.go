@@ -0,0 +1,28 @@
+package broker
+
+import (
+	"time"
+
+	"tccgo/protocol"
+)
+
+// Publications with a time-to-live are delivered as regular publications with a deadline,
+// or not at all if they expire before being written to the connection.
+// Peers are sent the time that's left, so the deadline holds across servers.
+
+// forPeer turns a publication with a deadline into a TTLPubMsg with the time that's left
+func forPeer(m protocol.Msg, now time.Time) protocol.Msg {
+	if m.Type != protocol.PubMsg || m.Deadline.IsZero() {
+		return m
+	}
+	ttl := max(m.Deadline.Sub(now), time.Millisecond)
+	return protocol.Msg{Type: protocol.TTLPubMsg, Topic: m.Topic, Payload: protocol.TTLPayload(ttl, m.Payload), Deadline: m.Deadline}
+}
+
+func (st *serverStats) expirations() int64 {
+	n := st.expired.Load()
+	for _, ps := range st.parts {
+		n += ps.expired.Load()
+	}
+	return n
+}
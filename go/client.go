@@ -3,42 +3,44 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
+	"sync/atomic"
+
+	"tccgo/client"
+	"tccgo/protocol"
 )
 
-func runClient(address string) {
-	conn, err := net.Dial("tcp", address)
+func runClient(address string, session bool) {
+	count := new(atomic.Int64)
+	show := func(m protocol.Msg) {
+		fmt.Printf("< (%5d) %v\n", count.Add(1), m)
+	}
+
+	opts := []client.Option{client.WithUnhandled(show)}
+	if session {
+		opts = append(opts, client.WithSession())
+	}
+	c, err := client.Dial(address, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer c.Close()
 
-	mu := new(sync.Mutex)
-	write := func(m msg) {
-		mu.Lock()
-		defer mu.Unlock()
-		if _, err := m.WriteTo(conn); err != nil {
-			log.Fatal(err)
+	write := func(m protocol.Msg) {
+		if err := c.Send(m); err != nil {
+			fmt.Printf("< %v\n", err)
 		}
 	}
 
-	go func() {
-		tick := time.Tick(50 * time.Second)
-		for range tick {
-			write(msg{t: pingMsg})
-		}
-	}()
+	// topics whose subscription channel is being shown
+	showing := make(map[uint16]bool)
 
 	respace := regexp.MustCompile(`\s+`)
-
-	go cliReadFromConn(conn)
+	corr := uint32(0)
 
 	sc := bufio.NewScanner(os.Stdin)
 	for {
@@ -56,7 +58,16 @@ func runClient(address string) {
 			cmd, ss := ss[0], ss[1:]
 
 			if cmd == "ping" {
-				write(msg{t: pingMsg})
+				write(protocol.Msg{Type: protocol.PingMsg})
+				continue
+			}
+
+			if cmd == "auth" {
+				if len(ss) != 2 {
+					fmt.Printf("< username and token?\n")
+					continue
+				}
+				write(protocol.Msg{Type: protocol.AuthMsg, Payload: protocol.AuthPayload(ss[0], ss[1])})
 				continue
 			}
 
@@ -74,7 +85,7 @@ func runClient(address string) {
 			topic := uint16(topic64)
 
 			var payload string
-			if cmd == "pub" {
+			if cmd == "pub" || cmd == "tpub" || cmd == "gsub" || cmd == "gunsub" || cmd == "req" || cmd == "reply" {
 				if len(ss) == 0 {
 					fmt.Printf("< payload?\n")
 					continue
@@ -82,6 +93,11 @@ func runClient(address string) {
 				payload, ss = ss[0], ss[1:]
 			}
 
+			// optional filter, see filter.go
+			if cmd == "sub" && len(ss) > 0 {
+				payload, ss = ss[0], ss[1:]
+			}
+
 			if len(ss) != 0 {
 				fmt.Printf("< excess: %v\n", ss)
 				continue
@@ -89,11 +105,42 @@ func runClient(address string) {
 
 			switch cmd {
 			case "sub":
-				write(msg{t: subMsg, topic: topic})
+				ch, err := c.SubscribeFiltered(topic, payload)
+				if err != nil {
+					fmt.Printf("< %v\n", err)
+					continue
+				}
+				if !showing[topic] {
+					showing[topic] = true
+					go func() {
+						for m := range ch {
+							show(protocol.Msg{Type: protocol.PubMsg, Topic: m.Topic, Payload: m.Payload})
+						}
+					}()
+				}
 			case "unsub":
-				write(msg{t: unsubMsg, topic: topic})
+				delete(showing, topic)
+				if err := c.Unsubscribe(topic); err != nil {
+					fmt.Printf("< %v\n", err)
+				}
 			case "pub":
-				write(msg{t: pubMsg, topic: topic, payload: payload})
+				write(protocol.Msg{Type: protocol.PubMsg, Topic: topic, Payload: payload})
+			case "tpub":
+				// payload is "<ttl ms> <data>"
+				write(protocol.Msg{Type: protocol.TTLPubMsg, Topic: topic, Payload: payload})
+			case "gsub":
+				write(protocol.Msg{Type: protocol.GroupSubMsg, Topic: topic, Payload: payload})
+			case "gunsub":
+				write(protocol.Msg{Type: protocol.GroupUnsubMsg, Topic: topic, Payload: payload})
+			case "members":
+				write(protocol.Msg{Type: protocol.MembersMsg, Topic: topic})
+			case "req":
+				corr++
+				fmt.Printf("< request %d\n", corr)
+				write(protocol.Msg{Type: protocol.RequestMsg, Topic: topic, Payload: protocol.RequestPayload(corr, 0, payload)})
+			case "reply":
+				// payload is "<inbox> <corr> <data>", as received in the request
+				write(protocol.Msg{Type: protocol.ReplyMsg, Topic: topic, Payload: payload})
 			default:
 				fmt.Printf("< unknown command %q\n", cmd)
 			}
@@ -104,18 +151,3 @@ func runClient(address string) {
 		log.Fatal(err)
 	}
 }
-
-func cliReadFromConn(r io.Reader) {
-	count := 0
-	for {
-		var m msg
-		if _, err := m.ReadFrom(r); err != nil {
-			if err != io.EOF {
-				log.Fatal(err)
-			}
-		} else {
-			count++
-			fmt.Printf("< (%5d) %v\n", count, m)
-		}
-	}
-}
@@ -0,0 +1,558 @@
+package client
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tccgo/protocol"
+)
+
+var (
+	ErrClosed       = errors.New("client: closed")
+	ErrNotConnected = errors.New("client: not connected")
+	ErrTimeout      = errors.New("client: request timed out")
+)
+
+type zero = struct{}
+
+// Message is a publication received on a subscription
+type Message struct {
+	Topic   uint16
+	Payload string
+}
+
+type options struct {
+	username   string
+	token      string
+	ping       time.Duration
+	fixedPing  bool // otherwise the interval is adapted to the server's keepalive settings
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	buffer     int
+	unhandled  func(protocol.Msg)
+	session    bool
+}
+
+type Option func(*options)
+
+// WithAuth authenticates every connection, including the ones made when reconnecting
+func WithAuth(username, token string) Option {
+	return func(o *options) {
+		o.username, o.token = username, token
+	}
+}
+
+// WithPingInterval sets how often the server is pinged, so it doesn't close an idle connection.
+// Without it, the client asks the server how long it waits, and doesn't ping if the server does.
+func WithPingInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.ping, o.fixedPing = d, true
+	}
+}
+
+// WithBackoff sets the bounds of the time between reconnection attempts,
+// which starts at min and doubles after each failure
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.minBackoff, o.maxBackoff = min, max
+	}
+}
+
+// WithBuffer sets the capacity of subscription channels
+func WithBuffer(n int) Option {
+	return func(o *options) {
+		o.buffer = n
+	}
+}
+
+// WithUnhandled receives the messages that don't go to a subscription channel:
+// acks, errors, replies, and publications on topics that weren't subscribed with Subscribe.
+// It's called from the goroutine that reads the connection, and must not block.
+func WithUnhandled(f func(protocol.Msg)) Option {
+	return func(o *options) {
+		o.unhandled = f
+	}
+}
+
+// WithSession starts a session on the server, which keeps the subscriptions and the publications
+// missed while reconnecting, as long as the client is back before the server's grace period is over
+func WithSession() Option {
+	return func(o *options) {
+		o.session = true
+	}
+}
+
+type subscription struct {
+	filter string
+	c      chan Message
+	stop   chan zero // closed before c, so a blocked delivery gives up
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (s *subscription) deliver(m Message, done <-chan zero) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.c <- m:
+	case <-s.stop:
+	case <-done:
+	}
+}
+
+func (s *subscription) close() {
+	close(s.stop)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	close(s.c)
+}
+
+// Client keeps a connection to a server, reconnecting with exponential backoff whenever it's
+// lost and subscribing again to the topics it was subscribed to. Publications sent while
+// it's reconnecting fail with ErrNotConnected, and the ones published meanwhile are missed
+// unless it has a session, see WithSession.
+type Client struct {
+	address string
+	opts    options
+	done    chan zero // closed by Close
+	session string    // only used by connect
+
+	// held while sending subscription changes, so they're sent in the order they're made.
+	// mu is only held to read and change the state, the reading goroutine needs it for every
+	// publication, and the server may be waiting for it to read before reading what's written.
+	subMu sync.Mutex
+
+	mu      sync.Mutex
+	conn    *Conn // nil while reconnecting
+	subs    map[uint16]*subscription
+	unsent  map[uint16]zero // topics subscribed or unsubscribed while reconnecting
+	resumed bool            // whether the last connection resumed the session
+	ping    time.Duration   // 0 if the server pings instead
+	closed  bool
+	corr    uint32                       // of the last request
+	pending map[uint32]chan protocol.Msg // requests waiting for their reply or error, by corr
+
+	pinging atomic.Bool // whether a ping from the server would be the answer to ours
+}
+
+// Dial connects to the server at address, failing if the first connection fails
+func Dial(address string, opts ...Option) (*Client, error) {
+	o := options{
+		ping:       30 * time.Second,
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+		buffer:     16,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	c := &Client{
+		address: address,
+		opts:    o,
+		done:    make(chan zero),
+		subs:    make(map[uint16]*subscription),
+		unsent:  make(map[uint16]zero),
+		ping:    o.ping,
+		pending: make(map[uint32]chan protocol.Msg),
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.read(conn)
+	go c.keepalive()
+	return c, nil
+}
+
+func (c *Client) connect() (*Conn, error) {
+	conn, err := DialConn(c.address)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.username != "" {
+		if err := conn.Auth(c.opts.username, c.opts.token); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := expect(conn, protocol.AuthMsg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if !c.opts.fixedPing {
+		// before the session, whose missed publications come right after it's resumed
+		if err := conn.Send(protocol.Msg{Type: protocol.KeepaliveMsg}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		m, err := conn.Receive()
+		if err == nil && m.Type != protocol.KeepaliveMsg {
+			err = errors.New("client: " + m.Payload)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		idle, ping, ok := protocol.ParseKeepalivePayload(m.Payload)
+		if !ok {
+			conn.Close()
+			return nil, errors.New("client: malformed keepalive")
+		}
+		c.mu.Lock()
+		c.ping = idle / 2
+		if ping > 0 {
+			c.ping = 0
+		}
+		c.mu.Unlock()
+	}
+	if c.opts.session {
+		if err := conn.Send(protocol.Msg{Type: protocol.SessionMsg, Payload: c.session}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		m, err := conn.Receive()
+		if err == nil && m.Type != protocol.SessionMsg {
+			err = errors.New("client: " + m.Payload)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		id, resumed, ok := protocol.ParseSessionPayload(m.Payload)
+		if !ok {
+			conn.Close()
+			return nil, errors.New("client: malformed session")
+		}
+		c.session = id
+		c.mu.Lock()
+		c.resumed = resumed
+		c.mu.Unlock()
+	}
+	return conn, nil
+}
+
+func expect(conn *Conn, t protocol.MsgType) error {
+	m, err := conn.Receive()
+	if err != nil {
+		return err
+	}
+	if m.Type != t {
+		return errors.New("client: " + m.Payload)
+	}
+	return nil
+}
+
+func (c *Client) read(conn *Conn) {
+	for {
+		m, err := conn.Receive()
+		if err != nil {
+			conn.Close()
+			c.mu.Lock()
+			c.conn = nil
+			c.mu.Unlock()
+			if conn = c.reconnect(); conn == nil {
+				return
+			}
+			continue
+		}
+		switch m.Type {
+		case protocol.PingMsg:
+			// either the echo of our ping or a ping from the server, which must be answered
+			if !c.pinging.CompareAndSwap(true, false) {
+				conn.Ping()
+			}
+		case protocol.PubMsg:
+			c.mu.Lock()
+			s := c.subs[m.Topic]
+			c.mu.Unlock()
+			if s != nil {
+				s.deliver(Message{Topic: m.Topic, Payload: m.Payload}, c.done)
+			} else if c.opts.unhandled != nil {
+				c.opts.unhandled(m)
+			}
+		case protocol.ReplyMsg, protocol.ErrMsg:
+			if !c.answer(m) && c.opts.unhandled != nil {
+				c.opts.unhandled(m)
+			}
+		default:
+			if c.opts.unhandled != nil {
+				c.opts.unhandled(m)
+			}
+		}
+	}
+}
+
+// answer gives a reply, or an error about a request, to the Request waiting for it
+func (c *Client) answer(m protocol.Msg) bool {
+	var (
+		corr uint32
+		ok   bool
+	)
+	if m.Type == protocol.ReplyMsg {
+		corr, _, ok = protocol.ParseReplyPayload(m.Payload)
+	} else {
+		corr, _, ok = protocol.ParseRequestErrorPayload(m.Payload)
+	}
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	rc, ok := c.pending[corr]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case rc <- m:
+	default:
+		// it already has its answer, this one is late
+	}
+	return true
+}
+
+// reconnect returns the new connection, or nil if the client was closed in the meantime
+func (c *Client) reconnect() *Conn {
+	backoff := c.opts.minBackoff
+	for {
+		// up to 50% of jitter, so clients dropped together don't come back together
+		wait := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(wait):
+		}
+
+		conn, err := c.connect()
+		if err != nil {
+			backoff = min(2*backoff, c.opts.maxBackoff)
+			continue
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		c.conn = conn
+		c.mu.Unlock()
+		// from another goroutine, so this one goes back to reading
+		go c.resubscribe(conn)
+		return conn
+	}
+}
+
+// resubscribe sends the subscriptions to a new connection. Changes made before it gets to
+// send them were sent to the connection already, and are included or sent again.
+func (c *Client) resubscribe(conn *Conn) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.mu.Lock()
+	if c.conn != conn {
+		// lost already, the next connection sends them
+		c.mu.Unlock()
+		return
+	}
+	subs := make(map[uint16]string)
+	var unsubs []uint16
+	if c.resumed {
+		// the server kept the subscriptions, only the changes are missing
+		for t := range c.unsent {
+			if s, ok := c.subs[t]; ok {
+				subs[t] = s.filter
+			} else {
+				unsubs = append(unsubs, t)
+			}
+		}
+	} else {
+		for t, s := range c.subs {
+			subs[t] = s.filter
+		}
+	}
+	clear(c.unsent)
+	c.mu.Unlock()
+
+	for t, filter := range subs {
+		conn.SubscribeFiltered(t, filter)
+	}
+	for _, t := range unsubs {
+		conn.Unsubscribe(t)
+	}
+}
+
+func (c *Client) keepalive() {
+	for {
+		c.mu.Lock()
+		ping := c.ping
+		c.mu.Unlock()
+		// if the server pings, check again later in case it reconnects to one that doesn't
+		wait := ping
+		if wait == 0 {
+			wait = c.opts.ping
+		}
+		select {
+		case <-c.done:
+			return
+		case <-time.After(wait):
+		}
+		if ping == 0 {
+			continue
+		}
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn != nil {
+			// a failure is noticed by the reading goroutine
+			c.pinging.Store(true)
+			conn.Ping()
+		}
+	}
+}
+
+// Subscribe returns a channel with the publications on topic, which is closed by Unsubscribe.
+// Subscribing again to the same topic returns the same channel.
+func (c *Client) Subscribe(topic uint16) (<-chan Message, error) {
+	return c.SubscribeFiltered(topic, "")
+}
+
+// SubscribeFiltered is like Subscribe, but with a filter evaluated by the server, e.g. "prefix temp="
+func (c *Client) SubscribeFiltered(topic uint16, filter string) (<-chan Message, error) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	s, ok := c.subs[topic]
+	if !ok {
+		s = &subscription{
+			c:    make(chan Message, c.opts.buffer),
+			stop: make(chan zero),
+		}
+		c.subs[topic] = s
+	}
+	s.filter = filter
+	conn := c.conn
+	if conn == nil {
+		// the subscription is made when it reconnects
+		c.unsent[topic] = zero{}
+	}
+	c.mu.Unlock()
+	if conn != nil {
+		conn.SubscribeFiltered(topic, filter)
+	}
+	return s.c, nil
+}
+
+func (c *Client) Unsubscribe(topic uint16) error {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	s, ok := c.subs[topic]
+	delete(c.subs, topic)
+	conn := c.conn
+	if conn == nil {
+		c.unsent[topic] = zero{}
+	}
+	c.mu.Unlock()
+	if ok {
+		s.close()
+	}
+	if conn != nil {
+		return conn.Unsubscribe(topic)
+	}
+	return nil
+}
+
+func (c *Client) Publish(topic uint16, payload string) error {
+	return c.Send(protocol.Msg{Type: protocol.PubMsg, Topic: topic, Payload: payload})
+}
+
+// Request sends a request to the subscribers of topic and returns the data of the first reply.
+// It fails with ErrTimeout if there's no reply within timeout, which the server enforces too,
+// and with the server's error if no one is subscribed.
+func (c *Client) Request(topic uint16, payload string, timeout time.Duration) (string, error) {
+	rc := make(chan protocol.Msg, 1)
+	c.mu.Lock()
+	c.corr++
+	corr := c.corr
+	c.pending[corr] = rc
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, corr)
+		c.mu.Unlock()
+	}()
+
+	m := protocol.Msg{Type: protocol.RequestMsg, Topic: topic, Payload: protocol.RequestPayload(corr, timeout, payload)}
+	if err := c.Send(m); err != nil {
+		return "", err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case m := <-rc:
+		if m.Type == protocol.ReplyMsg {
+			_, data, _ := protocol.ParseReplyPayload(m.Payload)
+			return data, nil
+		}
+		if _, what, _ := protocol.ParseRequestErrorPayload(m.Payload); what == "timed out" {
+			return "", ErrTimeout
+		}
+		return "", errors.New("client: " + m.Payload)
+	case <-timer.C:
+		return "", ErrTimeout
+	case <-c.done:
+		return "", ErrClosed
+	}
+}
+
+// Send sends any message, the answers go to the function given with WithUnhandled
+func (c *Client) Send(m protocol.Msg) error {
+	c.mu.Lock()
+	conn, closed := c.conn, c.closed
+	c.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.Send(m)
+}
+
+// Close disconnects and closes every subscription channel
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	close(c.done)
+	conn, subs := c.conn, c.subs
+	c.conn, c.subs = nil, nil
+	c.mu.Unlock()
+
+	for _, s := range subs {
+		s.close()
+	}
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"tccgo/broker"
+	"tccgo/protocol"
+)
+
+func startServer(t *testing.T, address string) (*broker.Server, string) {
+	t.Helper()
+	s, err := broker.New(broker.WithPartitions(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return s, l.Addr().String()
+}
+
+func shutdown(t *testing.T, s *broker.Server) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// publishUntilReceived publishes until the subscription gets the publication,
+// since the subscription may still be on its way to the server
+func publishUntilReceived(t *testing.T, c *Client, ch <-chan Message, topic uint16, payload string) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		c.Publish(topic, payload)
+		select {
+		case m := <-ch:
+			if m.Topic != topic || m.Payload != payload {
+				t.Fatalf("got %v", m)
+			}
+			return
+		case <-tick.C:
+		case <-deadline:
+			t.Fatalf("never got %q", payload)
+		}
+	}
+}
+
+func TestClientReconnects(t *testing.T) {
+	s, address := startServer(t, "127.0.0.1:0")
+
+	c, err := Dial(address, WithBackoff(10*time.Millisecond, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ch, err := c.Subscribe(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishUntilReceived(t, c, ch, 3, "before")
+
+	shutdown(t, s)
+	s, _ = startServer(t, address)
+	defer shutdown(t, s)
+
+	// the subscription is made again once the client reconnects
+	publishUntilReceived(t, c, ch, 3, "after")
+
+	if err := c.Unsubscribe(3); err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+	}
+}
+
+func TestRequest(t *testing.T) {
+	s, address := startServer(t, "127.0.0.1:0")
+	defer shutdown(t, s)
+
+	requests := make(chan protocol.Msg, 16)
+	responder, err := Dial(address, WithUnhandled(func(m protocol.Msg) {
+		if m.Type == protocol.RequestMsg {
+			requests <- m
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	stop := make(chan zero)
+	defer close(stop)
+	go func() {
+		for {
+			var m protocol.Msg
+			select {
+			case <-stop:
+				return
+			case m = <-requests:
+			}
+			inbox, corr, data, _ := protocol.ParseRoutedPayload(m.Payload)
+			if data != "ignore" {
+				responder.Send(protocol.Msg{Type: protocol.ReplyMsg, Topic: m.Topic, Payload: protocol.RoutedPayload(inbox, corr, "re: "+data)})
+			}
+		}
+	}()
+	if _, err := responder.Subscribe(7); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// until the subscription reaches the server, there's no one to reply
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := c.Request(7, "hello", time.Second)
+		if err == nil {
+			if data != "re: hello" {
+				t.Fatalf("got reply %q", data)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := c.Request(7, "ignore", 50*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) != 0 {
+		t.Fatalf("%d requests still pending", len(c.pending))
+	}
+}
+
+func TestSubscribeDoesNotBlockReading(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	c, err := Dial(l.Addr().String(), WithPingInterval(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	server := <-accepted
+	defer server.Close()
+	ch, err := c.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server doesn't read, so subscribing eventually waits for it
+	stop := make(chan zero)
+	defer close(stop)
+	filter := "prefix " + strings.Repeat("x", protocol.MaxPayload-len("prefix "))
+	go func() {
+		for t := uint16(1); ; t++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.SubscribeFiltered(t, filter)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := (protocol.Msg{Type: protocol.PubMsg, Topic: 0, Payload: "still reading"}).WriteTo(server); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-ch:
+		if m.Payload != "still reading" {
+			t.Fatalf("got %v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the publication wasn't read while a subscription was being written")
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"sync"
+
+	"tccgo/protocol"
+)
+
+// Conn is a single connection to a server, see Client for one that stays connected.
+// Messages can be sent from any goroutine, but only one goroutine should receive.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex // serializes writes
+}
+
+func DialConn(address string) (*Conn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+// NewConn wraps an established connection, e.g. one end of a net.Pipe
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+func (c *Conn) Send(m protocol.Msg) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := m.WriteTo(c.conn)
+	return err
+}
+
+// Receive waits for the next message from the server
+func (c *Conn) Receive() (protocol.Msg, error) {
+	var m protocol.Msg
+	_, err := m.ReadFrom(c.r)
+	return m, err
+}
+
+func (c *Conn) Ping() error {
+	return c.Send(protocol.Msg{Type: protocol.PingMsg})
+}
+
+func (c *Conn) Auth(username, token string) error {
+	return c.Send(protocol.Msg{Type: protocol.AuthMsg, Payload: protocol.AuthPayload(username, token)})
+}
+
+func (c *Conn) Subscribe(topic uint16) error {
+	return c.Send(protocol.Msg{Type: protocol.SubMsg, Topic: topic})
+}
+
+// SubscribeFiltered subscribes to the publications that match filter, e.g. "prefix temp="
+func (c *Conn) SubscribeFiltered(topic uint16, filter string) error {
+	return c.Send(protocol.Msg{Type: protocol.SubMsg, Topic: topic, Payload: filter})
+}
+
+func (c *Conn) Unsubscribe(topic uint16) error {
+	return c.Send(protocol.Msg{Type: protocol.UnsubMsg, Topic: topic})
+}
+
+func (c *Conn) Publish(topic uint16, payload string) error {
+	return c.Send(protocol.Msg{Type: protocol.PubMsg, Topic: topic, Payload: payload})
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
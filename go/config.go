@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"tccgo/broker"
+)
+
+// serverConfig is everything the server can be configured with. It's read from the JSON file
+// given with --config over the defaults, and the flags override the file.
+// On SIGHUP, only limits.* and log.level are applied, and the credentials and acl files read
+// again: the rest, rate limits and keepalive included, needs a restart (see reloadable).
+type serverConfig struct {
+	Listen struct {
+		TCP   string `json:"tcp"`
+		MQTT  string `json:"mqtt"`
+		RESP  string `json:"resp"`
+		Admin string `json:"admin"`
+	} `json:"listen"`
+	Partitions      int      `json:"partitions"`
+	Engine          string   `json:"engine"`
+	GroupStrategy   string   `json:"groupStrategy"`
+	Presence        string   `json:"presence"`
+	TopicNames      string   `json:"topicNames"`
+	Auth            string   `json:"auth"`
+	ACL             string   `json:"acl"`
+	Peers           []string `json:"peers"`
+	PeerCredentials string   `json:"peerCredentials"`
+	Keepalive       struct {
+		Idle duration `json:"idle"`
+		Ping duration `json:"ping"`
+		Pong duration `json:"pong"`
+	} `json:"keepalive"`
+	WriteBatch struct {
+		Max   int      `json:"max"`
+		Delay duration `json:"delay"`
+	} `json:"writeBatch"`
+	Sessions struct {
+		Grace  duration `json:"grace"`
+		Buffer int      `json:"buffer"`
+	} `json:"sessions"`
+	RateLimit struct {
+		ConnRate   float64 `json:"connRate"`
+		ConnBurst  float64 `json:"connBurst"`
+		TopicRate  float64 `json:"topicRate"`
+		TopicBurst float64 `json:"topicBurst"`
+		Action     string  `json:"action"`
+	} `json:"rateLimit"`
+	Limits struct {
+		MaxConns        int    `json:"maxConns"`
+		MaxConnsPerIP   int    `json:"maxConnsPerIP"`
+		MaxSubsPerConn  int    `json:"maxSubsPerConn"`
+		MaxSubsPerTopic int    `json:"maxSubsPerTopic"`
+		Allow           string `json:"allow"`
+		Deny            string `json:"deny"`
+	} `json:"limits"`
+	Log struct {
+		Format string `json:"format"`
+		Level  string `json:"level"`
+	} `json:"log"`
+}
+
+// duration is a time.Duration written like "10s" in the config file
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func defaultServerConfig() serverConfig {
+	var c serverConfig
+	c.Engine = "channels"
+	c.GroupStrategy = "roundrobin"
+	c.Keepalive.Idle = duration(time.Minute)
+	c.Keepalive.Pong = duration(10 * time.Second)
+	c.WriteBatch.Max = 64
+	c.Sessions.Buffer = 256
+	c.RateLimit.ConnBurst = 1
+	c.RateLimit.TopicBurst = 1
+	c.RateLimit.Action = "delay"
+	c.Log.Format = "text"
+	c.Log.Level = "info"
+	return c
+}
+
+// flags makes the flags set c, with its current values as defaults
+func (c *serverConfig) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen.Admin, "admin", c.Listen.Admin, "address of the HTTP admin listener (disabled if empty)")
+	fs.StringVar(&c.Listen.MQTT, "mqtt", c.Listen.MQTT, "address of the MQTT listener (disabled if empty)")
+	fs.StringVar(&c.Listen.RESP, "resp", c.Listen.RESP, "address of the redis (RESP) listener (disabled if empty)")
+	fs.IntVar(&c.Partitions, "partitions", c.Partitions, "number of partitions (0 for the number of CPUs)")
+	fs.StringVar(&c.Engine, "engine", c.Engine, "how partitions are run: channels (a goroutine each) or locks (copy-on-write subscribers behind a RWMutex)")
+	fs.StringVar(&c.GroupStrategy, "group-strategy", c.GroupStrategy, "how consumer group members are chosen: roundrobin or leastloaded")
+	fs.StringVar(&c.Presence, "presence", c.Presence, "comma-separated topic ranges with presence events, published to the topic plus 32768")
+	fs.StringVar(&c.TopicNames, "topic-names", c.TopicNames, "file mapping the topic names used by MQTT and RESP clients to topics")
+	fs.StringVar(&c.Auth, "auth", c.Auth, "credentials file, reloaded on SIGHUP; clients must authenticate if set")
+	fs.StringVar(&c.ACL, "acl", c.ACL, "publish/subscribe rules file, reloaded on SIGHUP")
+	fs.Var(&stringsFlag{values: &c.Peers}, "peer", "address of another server to link to, can be repeated and replaces the config file's peers; servers must be linked as a full mesh")
+	fs.StringVar(&c.PeerCredentials, "peer-credentials", c.PeerCredentials, "username:token to authenticate with peers")
+	fs.DurationVar((*time.Duration)(&c.Keepalive.Idle), "idle-timeout", time.Duration(c.Keepalive.Idle), "close connections that send nothing for this long")
+	fs.DurationVar((*time.Duration)(&c.Keepalive.Ping), "ping-interval", time.Duration(c.Keepalive.Ping), "ping connections that are quiet for this long (0 to never ping them)")
+	fs.DurationVar((*time.Duration)(&c.Keepalive.Pong), "pong-timeout", time.Duration(c.Keepalive.Pong), "close pinged connections that don't answer within this long")
+	fs.IntVar(&c.WriteBatch.Max, "write-batch", c.WriteBatch.Max, "maximum number of messages written to a connection at once")
+	fs.DurationVar((*time.Duration)(&c.WriteBatch.Delay), "write-delay", time.Duration(c.WriteBatch.Delay), "how long to wait for more messages before writing to a connection (0 to write what's queued right away)")
+	fs.DurationVar((*time.Duration)(&c.Sessions.Grace), "session-grace", time.Duration(c.Sessions.Grace), "how long a session's subscriptions are kept after its connection is gone (sessions are disabled if 0)")
+	fs.IntVar(&c.Sessions.Buffer, "session-buffer", c.Sessions.Buffer, "maximum number of publications kept for a disconnected session")
+	fs.Float64Var(&c.RateLimit.ConnRate, "conn-rate", c.RateLimit.ConnRate, "publications per second allowed per connection (0 for no limit)")
+	fs.Float64Var(&c.RateLimit.ConnBurst, "conn-burst", c.RateLimit.ConnBurst, "burst size of the per-connection rate limit")
+	fs.Float64Var(&c.RateLimit.TopicRate, "topic-rate", c.RateLimit.TopicRate, "publications per second allowed per topic (0 for no limit)")
+	fs.Float64Var(&c.RateLimit.TopicBurst, "topic-burst", c.RateLimit.TopicBurst, "burst size of the per-topic rate limit")
+	fs.StringVar(&c.RateLimit.Action, "rate-action", c.RateLimit.Action, "what to do when a rate limit is exceeded: delay, drop or disconnect")
+	fs.IntVar(&c.Limits.MaxConns, "max-conns", c.Limits.MaxConns, "maximum number of connections (0 for no limit)")
+	fs.IntVar(&c.Limits.MaxConnsPerIP, "max-conns-per-ip", c.Limits.MaxConnsPerIP, "maximum number of connections from a single address (0 for no limit)")
+	fs.IntVar(&c.Limits.MaxSubsPerConn, "max-subs-per-conn", c.Limits.MaxSubsPerConn, "maximum number of topics a connection can subscribe to (0 for no limit)")
+	fs.IntVar(&c.Limits.MaxSubsPerTopic, "max-subs-per-topic", c.Limits.MaxSubsPerTopic, "maximum number of subscribers of a topic (0 for no limit)")
+	fs.StringVar(&c.Limits.Allow, "allow", c.Limits.Allow, "comma-separated CIDRs allowed to connect (everyone if empty)")
+	fs.StringVar(&c.Limits.Deny, "deny", c.Limits.Deny, "comma-separated CIDRs not allowed to connect")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "format of the log written to stderr: text or json")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "minimum level logged: debug, info, warn or error")
+}
+
+func (c *serverConfig) readFile(path string) error {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(bs))
+	d.DisallowUnknownFields()
+	if err := d.Decode(c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// parseServerConfig reads the configuration from the defaults, the file given with --config,
+// the other flags and the address, each overriding the ones before. It returns the file's path.
+func parseServerConfig(args []string, address string, eh flag.ErrorHandling) (serverConfig, string, error) {
+	c := defaultServerConfig()
+	fs := flag.NewFlagSet("server", eh)
+	path := fs.String("config", "", "JSON configuration file, reloaded on SIGHUP for the limits and log level, the rest needs a restart (flags override it)")
+	c.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return serverConfig{}, "", err
+	}
+	if *path != "" {
+		c = defaultServerConfig()
+		if err := c.readFile(*path); err != nil {
+			return serverConfig{}, "", err
+		}
+		// again, over the file
+		fs := flag.NewFlagSet("server", flag.ContinueOnError)
+		fs.String("config", "", "")
+		c.flags(fs)
+		if err := fs.Parse(args); err != nil {
+			return serverConfig{}, "", err
+		}
+	}
+	if address != "" {
+		c.Listen.TCP = address
+	}
+	return c, *path, c.validate()
+}
+
+func (c serverConfig) validate() error {
+	if c.Listen.TCP == "" {
+		return errors.New("no address to listen on, give it before the flags or in the config file")
+	}
+	if _, err := parseLevel(c.Log.Level); err != nil {
+		return err
+	}
+	if _, err := makeLogger(c.Log.Format, slog.LevelInfo); err != nil {
+		return err
+	}
+	opts, err := c.options()
+	if err != nil {
+		return err
+	}
+	return broker.CheckOptions(opts...)
+}
+
+func (c serverConfig) limits() (broker.LimitsConfig, error) {
+	lc := broker.LimitsConfig{
+		MaxConns:        c.Limits.MaxConns,
+		MaxConnsPerIP:   c.Limits.MaxConnsPerIP,
+		MaxSubsPerConn:  c.Limits.MaxSubsPerConn,
+		MaxSubsPerTopic: c.Limits.MaxSubsPerTopic,
+	}
+	var err error
+	if lc.Allow, err = broker.ParseCIDRs(c.Limits.Allow); err != nil {
+		return lc, err
+	}
+	if lc.Deny, err = broker.ParseCIDRs(c.Limits.Deny); err != nil {
+		return lc, err
+	}
+	return lc, nil
+}
+
+func (c serverConfig) options() ([]broker.Option, error) {
+	action, err := broker.ParseRateLimitAction(c.RateLimit.Action)
+	if err != nil {
+		return nil, err
+	}
+	gs, err := broker.ParseGroupStrategy(c.GroupStrategy)
+	if err != nil {
+		return nil, err
+	}
+	engine, err := broker.ParseEngine(c.Engine)
+	if err != nil {
+		return nil, err
+	}
+	lc, err := c.limits()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []broker.Option{
+		broker.WithRateLimit(broker.RateLimitConfig{
+			ConnRate:   c.RateLimit.ConnRate,
+			ConnBurst:  c.RateLimit.ConnBurst,
+			TopicRate:  c.RateLimit.TopicRate,
+			TopicBurst: c.RateLimit.TopicBurst,
+			Action:     action,
+		}),
+		broker.WithLimits(lc),
+		broker.WithGroupStrategy(gs),
+		broker.WithPeers(c.PeerCredentials, c.Peers...),
+		broker.WithKeepalive(broker.KeepaliveConfig{
+			Idle: time.Duration(c.Keepalive.Idle),
+			Ping: time.Duration(c.Keepalive.Ping),
+			Pong: time.Duration(c.Keepalive.Pong),
+		}),
+		broker.WithWriteBatching(broker.WriteBatchConfig{
+			MaxBatch: c.WriteBatch.Max,
+			MaxDelay: time.Duration(c.WriteBatch.Delay),
+		}),
+		broker.WithEngine(engine),
+	}
+	if c.Partitions != 0 {
+		opts = append(opts, broker.WithPartitions(c.Partitions))
+	}
+	if c.Auth != "" {
+		opts = append(opts, broker.WithCredentialsFile(c.Auth))
+	}
+	if c.ACL != "" {
+		opts = append(opts, broker.WithACLFile(c.ACL))
+	}
+	if c.Presence != "" {
+		trs, err := broker.ParseTopicRanges(c.Presence)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, broker.WithPresence(trs))
+	}
+	if c.TopicNames != "" {
+		opts = append(opts, broker.WithTopicNamesFile(c.TopicNames))
+	}
+	if c.Sessions.Grace > 0 {
+		opts = append(opts, broker.WithSessions(time.Duration(c.Sessions.Grace), c.Sessions.Buffer))
+	}
+	return opts, nil
+}
+
+// settings flattens the configuration into its JSON names, like "keepalive.idle"
+func (c serverConfig) settings() map[string]string {
+	bs, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(bs, &m); err != nil {
+		panic(err)
+	}
+	r := make(map[string]string)
+	flattenSettings("", m, r)
+	return r
+}
+
+func flattenSettings(prefix string, m map[string]any, r map[string]string) {
+	for k, v := range m {
+		if sub, ok := v.(map[string]any); ok {
+			flattenSettings(prefix+k+".", sub, r)
+			continue
+		}
+		r[prefix+k] = fmt.Sprint(v)
+	}
+}
+
+type configChange struct {
+	setting string
+	old     string
+	new     string
+}
+
+// changes lists the settings that differ in n, by name
+func (c serverConfig) changes(n serverConfig) []configChange {
+	cs, ns := c.settings(), n.settings()
+	var r []configChange
+	for k, v := range cs {
+		if ns[k] != v {
+			r = append(r, configChange{k, v, ns[k]})
+		}
+	}
+	slices.SortFunc(r, func(a, b configChange) int { return strings.Compare(a.setting, b.setting) })
+	return r
+}
+
+// reloadable tells whether a setting is applied on SIGHUP, the others need a restart
+func reloadable(setting string) bool {
+	return strings.HasPrefix(setting, "limits.") || setting == "log.level"
+}
+
+// reloadServer reads the configuration again and applies the settings that can change without
+// dropping connections, logging what changed. The credentials and acl files are read again too.
+func reloadServer(b *broker.Server, current *serverConfig, args []string, address string, level *slog.LevelVar) {
+	// validated like at startup, so an invalid burst or keepalive keeps the previous configuration
+	c, path, err := parseServerConfig(args, address, flag.ContinueOnError)
+	if err != nil {
+		slog.Error("failed to reload the configuration, keeping the previous one", "err", err)
+		return
+	}
+
+	restart := 0
+	changes := current.changes(c)
+	for _, ch := range changes {
+		if !reloadable(ch.setting) {
+			restart++
+			slog.Warn("setting changed, restart the server to apply it", "setting", ch.setting, "old", ch.old, "new", ch.new)
+			continue
+		}
+		slog.Info("setting changed", "setting", ch.setting, "old", ch.old, "new", ch.new)
+	}
+	// validated by parseServerConfig
+	lc, _ := c.limits()
+	l, _ := parseLevel(c.Log.Level)
+	b.SetLimits(lc)
+	level.Set(l)
+	// the others are still reported as changed until the restart
+	current.Limits, current.Log.Level = c.Limits, c.Log.Level
+
+	if current.Auth != "" {
+		if err := b.ReloadCredentials(); err != nil {
+			slog.Error("failed to reload credentials, keeping the previous ones", "err", err)
+		} else {
+			slog.Info("reloaded credentials", "path", current.Auth)
+		}
+	}
+	if current.ACL != "" {
+		if err := b.ReloadACL(); err != nil {
+			slog.Error("failed to reload acl, keeping the previous one", "err", err)
+		} else {
+			slog.Info("reloaded acl", "path", current.ACL)
+		}
+	}
+	slog.Info("reloaded configuration", "path", path, "changed", len(changes), "needRestart", restart)
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strings"
+	"syscall"
+
+	"tccgo/broker"
 )
 
 func main() {
@@ -27,6 +33,8 @@ func main() {
 		clientMain(args)
 	case "test":
 		testMain(args)
+	case "credential":
+		credentialMain(args)
 	default:
 		fmt.Printf("unknown command %q\n", cmd)
 	}
@@ -55,29 +63,144 @@ func prof() {
 	signal.Notify(c, os.Interrupt)
 }
 
-func serverMain(args []string) {
-	if len(args) == 0 {
-		fmt.Println("address?")
-		return
+// stringsFlag is a flag that can be repeated. Its first value replaces the list it was given,
+// which may come from the config file, and the others are added to it.
+type stringsFlag struct {
+	values *[]string
+	set    bool
+}
+
+func (sf *stringsFlag) String() string {
+	if sf.values == nil {
+		return ""
 	}
+	return strings.Join(*sf.values, ",")
+}
 
-	dbg("GOMAXPROCS = %d", runtime.GOMAXPROCS(-1))
+func (sf *stringsFlag) Set(s string) error {
+	if !sf.set {
+		*sf.values, sf.set = nil, true
+	}
+	*sf.values = append(*sf.values, s)
+	return nil
+}
+
+func onHangup(f func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			f()
+		}
+	}()
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+// makeLogger makes a logger writing to stderr, as text or JSON lines
+func makeLogger(format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// logFlags adds the flags for makeLogger
+func logFlags(fs *flag.FlagSet) (format *string, level *string) {
+	format = fs.String("log-format", "text", "format of the log written to stderr: text or json")
+	level = fs.String("log-level", "info", "minimum level logged: debug, info, warn or error")
+	return format, level
+}
+
+// serverMain takes the address to listen on as the first argument, unless it's in the config file
+func serverMain(args []string) {
+	address := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		address, args = args[0], args[1:]
+	}
 
 	// prof()
 
-	l, err := net.Listen("tcp", args[0])
+	c, _, err := parseServerConfig(args, address, flag.ExitOnError)
 	if err != nil {
 		log.Fatal(err)
 	}
-	_ = args[1:]
 
-	address := l.Addr()
-	fmt.Printf("listening on %v\n", address)
+	level := new(slog.LevelVar)
+	l, _ := parseLevel(c.Log.Level)
+	level.Set(l)
+	logger, err := makeLogger(c.Log.Format, level)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the log package writes through it too
+	slog.SetDefault(logger)
+	slog.Debug("starting", "gomaxprocs", runtime.GOMAXPROCS(-1))
 
-	sv := makeServer(numPartitions)
-	sv.start()
+	opts, err := c.options()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts = append(opts, broker.WithLogger(logger))
 
-	serve(l, sv)
+	ln, err := net.Listen("tcp", c.Listen.TCP)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	slog.Info("listening", "address", ln.Addr().String())
+
+	b, err := broker.New(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	onHangup(func() {
+		reloadServer(b, &c, args, address, level)
+	})
+
+	if c.Listen.MQTT != "" {
+		ml, err := net.Listen("tcp", c.Listen.MQTT)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("listening", "proto", "mqtt", "address", ml.Addr().String())
+		go b.ServeMQTT(ml)
+	}
+
+	if c.Listen.RESP != "" {
+		rl, err := net.Listen("tcp", c.Listen.RESP)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("listening", "proto", "resp", "address", rl.Addr().String())
+		go b.ServeRESP(rl)
+	}
+
+	if c.Listen.Admin != "" {
+		al, err := net.Listen("tcp", c.Listen.Admin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("listening", "proto", "admin", "address", al.Addr().String())
+		go func() {
+			if err := b.ServeAdmin(al); err != nil {
+				slog.Error("admin listener failed", "err", err)
+			}
+		}()
+	}
+
+	if err := b.Serve(ln); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func clientMain(args []string) {
@@ -85,8 +208,23 @@ func clientMain(args []string) {
 		fmt.Println("address?")
 		return
 	}
-	address, _ := args[0], args[1:]
-	runClient(address)
+	address, args := args[0], args[1:]
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	session := fs.Bool("session", false, "keep the subscriptions on the server while reconnecting (the server must have sessions enabled)")
+	fs.Parse(args)
+	runClient(address, *session)
+}
+
+func credentialMain(args []string) {
+	if len(args) != 2 {
+		fmt.Println("username and token?")
+		return
+	}
+	line, err := broker.CredentialLine(args[0], args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(line)
 }
 
 func testMain(args []string) {
@@ -101,15 +239,39 @@ func testMain(args []string) {
 		return
 	}
 	address, args := args[0], args[1:]
-	_ = args
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	admin := fs.String("admin", "", "address of the server's admin API, to show how many writes it made (throughput only)")
+	eventsPath := fs.String("events", "", "file to write the events the scripts process to, as JSON lines (stdout if empty)")
+	logFormat, logLevel := logFlags(fs)
+	fs.Parse(args)
+
+	level, err := parseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger, err := makeLogger(*logFormat, level)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	if *eventsPath != "" {
+		f, err := os.Create(*eventsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		events = makeEventLogger(f)
+	}
 
 	switch test {
 	case "throughput":
-		testThroughput(address)
+		testThroughput(address, *admin)
 	case "latency":
 		testLatency(address)
 	case "cpu":
 		testCpu(address)
+	case "request":
+		testRequest(address)
 	default:
 		fmt.Printf("unknown test %q\n", test)
 	}
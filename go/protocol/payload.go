@@ -0,0 +1,166 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Auth payloads are "username:token", the username can't contain ':'.
+func AuthPayload(username, token string) string {
+	return username + ":" + token
+}
+
+func ParseAuthPayload(p string) (username, token string, ok bool) {
+	return strings.Cut(p, ":")
+}
+
+// Requests are delivered like publications, but carry a correlation id and the id of the
+// requesting connection (its inbox), so replies can be routed straight back to it.
+// Payloads are text:
+//
+//	request, client to server:    "<corr> <timeout ms> <data>"
+//	request, server to responder: "<inbox> <corr> <data>"
+//	reply, responder to server:   "<inbox> <corr> <data>"
+//	reply, server to client:      "<corr> <data>"
+//
+// If no reply arrives in time the client gets an err message "request <corr> timed out".
+
+func RequestPayload(corr uint32, timeout time.Duration, data string) string {
+	return fmt.Sprintf("%d %d %s", corr, timeout.Milliseconds(), data)
+}
+
+func ParseRequestPayload(p string) (corr uint32, timeout time.Duration, data string, ok bool) {
+	ss := strings.SplitN(p, " ", 3)
+	if len(ss) != 3 {
+		return 0, 0, "", false
+	}
+	c, err := strconv.ParseUint(ss[0], 10, 32)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	ms, err := strconv.ParseUint(ss[1], 10, 32)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	return uint32(c), time.Duration(ms) * time.Millisecond, ss[2], true
+}
+
+// RoutedPayload is the payload of requests delivered to responders, and of their replies
+func RoutedPayload(inbox uint64, corr uint32, data string) string {
+	return fmt.Sprintf("%d %d %s", inbox, corr, data)
+}
+
+func ParseRoutedPayload(p string) (inbox uint64, corr uint32, data string, ok bool) {
+	ss := strings.SplitN(p, " ", 3)
+	if len(ss) != 3 {
+		return 0, 0, "", false
+	}
+	i, err := strconv.ParseUint(ss[0], 10, 64)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	c, err := strconv.ParseUint(ss[1], 10, 32)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	return i, uint32(c), ss[2], true
+}
+
+func ReplyPayload(corr uint32, data string) string {
+	return fmt.Sprintf("%d %s", corr, data)
+}
+
+func ParseReplyPayload(p string) (corr uint32, data string, ok bool) {
+	cs, data, ok := strings.Cut(p, " ")
+	if !ok {
+		return 0, "", false
+	}
+	c, err := strconv.ParseUint(cs, 10, 32)
+	if err != nil {
+		return 0, "", false
+	}
+	return uint32(c), data, true
+}
+
+// RequestErrorPayload is the payload of err messages about a request, e.g. "request 17 timed out"
+func RequestErrorPayload(corr uint32, what string) string {
+	return fmt.Sprintf("request %d %s", corr, what)
+}
+
+func ParseRequestErrorPayload(p string) (corr uint32, what string, ok bool) {
+	rest, ok := strings.CutPrefix(p, "request ")
+	if !ok {
+		return 0, "", false
+	}
+	return ParseReplyPayload(rest)
+}
+
+// Publications can carry a time-to-live, as a TTLPubMsg with "<ttl ms> <data>" as the payload.
+// Subscribers receive them as regular publications, with a deadline set by the server.
+
+func TTLPayload(ttl time.Duration, data string) string {
+	return fmt.Sprintf("%d %s", ttl.Milliseconds(), data)
+}
+
+func ParseTTLPayload(p string) (time.Duration, string, bool) {
+	ms, data, ok := strings.Cut(p, " ")
+	if !ok {
+		return 0, "", false
+	}
+	n, err := strconv.ParseUint(ms, 10, 32)
+	if err != nil || n == 0 {
+		return 0, "", false
+	}
+	return time.Duration(n) * time.Millisecond, data, true
+}
+
+func (m Msg) Expired(now time.Time) bool {
+	return !m.Deadline.IsZero() && !now.Before(m.Deadline)
+}
+
+// Sessions keep a connection's subscriptions on the server across reconnects.
+// Right after authenticating, the client sends a SessionMsg with the id of the session to resume,
+// or an empty payload to start a new one. The server answers "<id> new" or "<id> resumed";
+// publications missed while disconnected are delivered after a resumed answer.
+
+func ParseSessionPayload(p string) (id string, resumed bool, ok bool) {
+	id, state, ok := strings.Cut(p, " ")
+	if !ok || id == "" {
+		return "", false, false
+	}
+	switch state {
+	case "new":
+		return id, false, true
+	case "resumed":
+		return id, true, true
+	default:
+		return "", false, false
+	}
+}
+
+// A KeepaliveMsg with an empty payload asks for the server's keepalive settings, which it answers
+// with "<idle ms> <ping ms>": connections that send nothing for idle are closed, and if ping isn't 0
+// the server pings connections that are quiet for that long, and closes them if they don't answer.
+// Pings from the server are answered with a ping, which the server doesn't echo back.
+
+func KeepalivePayload(idle, ping time.Duration) string {
+	return fmt.Sprintf("%d %d", idle.Milliseconds(), ping.Milliseconds())
+}
+
+func ParseKeepalivePayload(p string) (idle, ping time.Duration, ok bool) {
+	is, ps, ok := strings.Cut(p, " ")
+	if !ok {
+		return 0, 0, false
+	}
+	i, err := strconv.ParseUint(is, 10, 32)
+	if err != nil || i == 0 {
+		return 0, 0, false
+	}
+	n, err := strconv.ParseUint(ps, 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return time.Duration(i) * time.Millisecond, time.Duration(n) * time.Millisecond, true
+}
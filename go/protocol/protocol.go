@@ -0,0 +1,326 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+type MsgType uint8
+
+const (
+	PingMsg  = MsgType(0)
+	PubMsg   = MsgType(1)
+	SubMsg   = MsgType(2)
+	UnsubMsg = MsgType(4)
+	ErrMsg   = MsgType(8)
+	AuthMsg  = MsgType(9)
+	PeerMsg  = MsgType(10)
+	// sub and unsub of consumer groups, the payload is the group name
+	GroupSubMsg   = MsgType(11)
+	GroupUnsubMsg = MsgType(12)
+	// asks for the connections subscribed to a topic with presence,
+	// the answer has their ids separated by spaces as the payload
+	MembersMsg = MsgType(13)
+	// request and reply payloads are described in payload.go
+	RequestMsg = MsgType(14)
+	ReplyMsg   = MsgType(15)
+	// publication with a time-to-live, see payload.go
+	TTLPubMsg = MsgType(16)
+	// starts or resumes a session, see payload.go
+	SessionMsg = MsgType(17)
+	// asks for the server's keepalive settings, see payload.go
+	KeepaliveMsg = MsgType(18)
+)
+
+// MaxPayload is the largest payload a message can carry, the size also counts its type and topic
+const MaxPayload = 1<<16 - 1 - 3
+
+var ErrInvalidSize = errors.New("invalid message size")
+
+// whether messages of this type carry a payload after the topic
+func (t MsgType) HasPayload() bool {
+	switch t {
+	case PubMsg, SubMsg, ErrMsg, AuthMsg, PeerMsg, GroupSubMsg, GroupUnsubMsg, MembersMsg, RequestMsg, ReplyMsg, TTLPubMsg, SessionMsg, KeepaliveMsg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t MsgType) Name() string {
+	switch t {
+	case PingMsg:
+		return "ping"
+	case PubMsg:
+		return "pub"
+	case SubMsg:
+		return "sub"
+	case UnsubMsg:
+		return "unsub"
+	case ErrMsg:
+		return "err"
+	case AuthMsg:
+		return "auth"
+	case PeerMsg:
+		return "peer"
+	case GroupSubMsg:
+		return "gsub"
+	case GroupUnsubMsg:
+		return "gunsub"
+	case MembersMsg:
+		return "members"
+	case RequestMsg:
+		return "request"
+	case ReplyMsg:
+		return "reply"
+	case TTLPubMsg:
+		return "tpub"
+	case SessionMsg:
+		return "session"
+	case KeepaliveMsg:
+		return "keepalive"
+	default:
+		return fmt.Sprintf("invalid_%d", t)
+	}
+}
+
+type Msg struct {
+	Type    MsgType
+	Topic   uint16
+	Payload string
+	// zero if the message doesn't expire, it isn't part of the encoding
+	Deadline time.Time
+	// set by Encoded, shared by every copy of the message and never modified
+	wire []byte
+}
+
+// Encoded returns the message with its encoding attached, so writing it to many
+// connections encodes it only once. Changing the copies' fields doesn't change what's written.
+func (m Msg) Encoded() Msg {
+	buf := bytes.NewBuffer(make([]byte, 0, 2+1+2+len(m.Payload)))
+	m.wire = nil
+	if _, err := m.WriteTo(buf); err != nil {
+		// too large, writing it fails the same way later
+		return m
+	}
+	m.wire = buf.Bytes()
+	return m
+}
+
+var _ io.WriterTo = Msg{}
+var _ io.ReaderFrom = &Msg{}
+var _ fmt.Stringer = Msg{}
+
+// ping is a 0-sized msg
+
+func (m Msg) WriteTo(w io.Writer) (int64, error) {
+	if m.wire != nil {
+		nn, err := writefull(w, m.wire)
+		return int64(nn), err
+	}
+
+	var (
+		n   int64
+		nn  int
+		err error
+		buf [2]byte
+	)
+
+	if m.Type.HasPayload() && len(m.Payload) > MaxPayload {
+		return 0, ErrInvalidSize
+	}
+	size := uint16(0)
+	psize := uint16(len(m.Payload))
+	if m.Type != PingMsg {
+		size += 1 // type
+		size += 2 // topic
+		if m.Type.HasPayload() {
+			size += psize
+		}
+	}
+
+	binary.BigEndian.PutUint16(buf[:2], size)
+	nn, err = writefull(w, buf[:2])
+	if err != nil {
+		return n, err
+	}
+	n += int64(nn)
+
+	if m.Type == PingMsg {
+		return n, nil
+	}
+
+	buf[0] = byte(m.Type)
+	nn, err = writefull(w, buf[:1])
+	if err != nil {
+		return n, err
+	}
+	n += int64(nn)
+
+	binary.BigEndian.PutUint16(buf[:2], m.Topic)
+	nn, err = writefull(w, buf[:2])
+	if err != nil {
+		return n, err
+	}
+	n += int64(nn)
+
+	if m.Type.HasPayload() {
+		nn, err = writefull(w, []byte(m.Payload)[:int(psize)])
+		if err != nil {
+			return n, err
+		}
+		n += int64(nn)
+	}
+
+	return n, nil
+}
+
+func (m *Msg) ReadFrom(r io.Reader) (int64, error) {
+	var (
+		n   int64
+		nn  int
+		err error
+		buf [2]byte
+	)
+
+	nn, err = readfull(r, buf[:])
+	n += int64(nn) // counted even on errors, so callers can tell whether a message was cut in half
+	if err != nil {
+		return n, err
+	}
+
+	size := binary.BigEndian.Uint16(buf[:2])
+
+	if size == 0 {
+		m.Type = PingMsg
+		return n, nil
+	}
+	if size < 3 {
+		return n, ErrInvalidSize
+	}
+
+	nn, err = readfull(r, buf[:1])
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+	t := MsgType(buf[0])
+	m.Type = t
+
+	nn, err = readfull(r, buf[:2])
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+	topic := binary.BigEndian.Uint16(buf[:2])
+	m.Topic = topic
+
+	m.Payload = ""
+	// payloads of types that don't carry one are read and discarded
+	if psize := size - 1 - 2; psize > 0 { // - type - topic
+		bb := new(bytes.Buffer)
+		bb.Grow(int(psize))
+		nn, err := bb.ReadFrom(io.LimitReader(r, int64(psize)))
+		n += nn
+		if err != nil {
+			return n, err
+		}
+
+		if t.HasPayload() {
+			m.Payload = bb.String()
+		}
+	}
+
+	return n, nil
+}
+
+func (a Msg) eq(b Msg) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	if a.Type != PingMsg {
+		if a.Topic != b.Topic {
+			return false
+		}
+		if a.Type.HasPayload() {
+			if a.Payload != b.Payload {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (m Msg) String() string {
+	switch m.Type {
+	case PingMsg:
+		return "msg{ping}"
+	case SubMsg:
+		if m.Payload != "" {
+			return fmt.Sprintf("msg{sub, %d, %q}", m.Topic, m.Payload)
+		}
+		return fmt.Sprintf("msg{sub, %d}", m.Topic)
+	case UnsubMsg:
+		return fmt.Sprintf("msg{unsub, %d}", m.Topic)
+	case PubMsg:
+		return fmt.Sprintf("msg{pub, %d, %q}", m.Topic, m.Payload)
+	case ErrMsg:
+		return fmt.Sprintf("msg{err, %d, %q}", m.Topic, m.Payload)
+	case AuthMsg:
+		return "msg{auth}"
+	case PeerMsg:
+		return fmt.Sprintf("msg{peer, %q}", m.Payload)
+	case GroupSubMsg:
+		return fmt.Sprintf("msg{gsub, %d, %q}", m.Topic, m.Payload)
+	case GroupUnsubMsg:
+		return fmt.Sprintf("msg{gunsub, %d, %q}", m.Topic, m.Payload)
+	case MembersMsg:
+		return fmt.Sprintf("msg{members, %d, %q}", m.Topic, m.Payload)
+	case RequestMsg:
+		return fmt.Sprintf("msg{request, %d, %q}", m.Topic, m.Payload)
+	case ReplyMsg:
+		return fmt.Sprintf("msg{reply, %d, %q}", m.Topic, m.Payload)
+	case TTLPubMsg:
+		return fmt.Sprintf("msg{tpub, %d, %q}", m.Topic, m.Payload)
+	case SessionMsg:
+		return fmt.Sprintf("msg{session, %q}", m.Payload)
+	case KeepaliveMsg:
+		return fmt.Sprintf("msg{keepalive, %q}", m.Payload)
+	default:
+		return fmt.Sprintf("msg{<invalid %d>, %d, %v}", m.Type, m.Topic, m.Payload)
+	}
+}
+
+func readfull(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	rem := buf[:]
+	for len(rem) > 0 {
+		nn, err := r.Read(rem)
+		if err != nil {
+			return n, err
+		}
+		rem = rem[nn:]
+		n += nn
+	}
+	return n, nil
+}
+
+// NOTE: this function is actually useless
+// every io.Writer impl should return an error if it wasn't able to write all the given bytes
+func writefull(w io.Writer, buf []byte) (int, error) {
+	n := 0
+	rem := buf[:]
+	for len(rem) > 0 {
+		nn, err := w.Write(rem)
+		if err != nil {
+			return n, err
+		}
+		rem = rem[nn:]
+		n += nn
+	}
+	return n, nil
+}
@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestProtocol(t *testing.T) {
+	ms := []Msg{
+		{Type: PingMsg},
+		{Type: PingMsg, Topic: 123, Payload: "abcba"},
+		{Type: SubMsg, Topic: 120, Payload: "lol ignored"},
+		{Type: UnsubMsg, Topic: 120, Payload: "lol ignored"},
+		{Type: SubMsg, Topic: 120},
+		{Type: SubMsg, Topic: 120, Payload: "regexp ^temp=[0-9]+$"},
+		{Type: UnsubMsg, Topic: 120},
+		{Type: PubMsg, Topic: 99, Payload: "hello"},
+		{Type: PubMsg, Topic: 129, Payload: "now this is a really really long message :) üỳʔ oo--"},
+		{Type: PubMsg, Topic: 0, Payload: ""},
+		{Type: ErrMsg, Topic: 12, Payload: "authentication failed"},
+		{Type: AuthMsg, Payload: "user:t0k:en"},
+		{Type: AuthMsg},
+		{Type: PeerMsg, Payload: "0123456789abcdef"},
+		{Type: GroupSubMsg, Topic: 7, Payload: "workers"},
+		{Type: GroupUnsubMsg, Topic: 7, Payload: "workers"},
+		{Type: MembersMsg, Topic: 7},
+		{Type: MembersMsg, Topic: 7, Payload: "1 5 12"},
+		{Type: RequestMsg, Topic: 3, Payload: "17 5000 what time is it"},
+		{Type: ReplyMsg, Topic: 3, Payload: "17 noon"},
+		{Type: TTLPubMsg, Topic: 40, Payload: "1500 temp=20"},
+		{Type: SessionMsg, Payload: "9f86d081884c7d65 resumed"},
+		{Type: KeepaliveMsg, Payload: "60000 15000"},
+	}
+	bb := new(bytes.Buffer)
+	for _, m := range ms {
+		bb.Reset()
+		if n, err := m.WriteTo(bb); err != nil {
+			t.Log(err)
+			t.FailNow()
+		} else {
+			t.Logf("wrote %d", n)
+		}
+		var mm Msg
+		bs := bb.Bytes()
+		if n, err := mm.ReadFrom(bytes.NewReader(bs)); err != nil && err != io.EOF {
+			t.Log(bb.Bytes())
+			t.Log(m)
+			t.Log(mm)
+			t.Log(err)
+			t.FailNow()
+		} else {
+			t.Logf("read %d", n)
+		}
+
+		if !m.eq(mm) {
+			t.Logf("wanted %v (%#v) got %v", m, m, mm)
+			t.FailNow()
+		}
+
+		// the encoding made beforehand is the same
+		var eb bytes.Buffer
+		if _, err := m.Encoded().WriteTo(&eb); err != nil || !bytes.Equal(eb.Bytes(), bs) {
+			t.Fatalf("encoded %v as %v, wanted %v (%v)", m, eb.Bytes(), bs, err)
+		}
+	}
+}
+
+func TestMaxPayload(t *testing.T) {
+	m := Msg{Type: PubMsg, Topic: 1, Payload: string(make([]byte, MaxPayload))}
+	var bb bytes.Buffer
+	if _, err := m.WriteTo(&bb); err != nil {
+		t.Fatal(err)
+	}
+	var mm Msg
+	if _, err := mm.ReadFrom(&bb); err != nil || !m.eq(mm) {
+		t.Fatalf("the largest payload didn't round trip: %v", err)
+	}
+
+	m.Payload += "x"
+	if _, err := m.WriteTo(&bb); err != ErrInvalidSize {
+		t.Fatalf("wrote a payload of %d bytes: %v", len(m.Payload), err)
+	}
+	if _, err := m.Encoded().WriteTo(&bb); err != ErrInvalidSize {
+		t.Fatalf("wrote an encoded payload of %d bytes: %v", len(m.Payload), err)
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	m := Msg{Type: PubMsg, Topic: 129, Payload: "pub 12 msg 3456 and some more bytes to make it realistic"}
+	b.Run("plain", func(b *testing.B) {
+		for range b.N {
+			m.WriteTo(io.Discard)
+		}
+	})
+	b.Run("encoded", func(b *testing.B) {
+		m := m.Encoded()
+		for range b.N {
+			m.WriteTo(io.Discard)
+		}
+	})
+}
@@ -6,8 +6,8 @@ import (
 	crand "crypto/rand"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand/v2"
-	"net"
 	"os"
 	"slices"
 	"strings"
@@ -15,109 +15,69 @@ import (
 	"sync/atomic"
 	"time"
 	"unique"
-)
-
-func fprf(w io.Writer, pre string, f string, a ...any) {
-	t := time.Now().UnixMicro()
-	fmt.Fprintf(w, "%s: %d %s\n", pre, t, fmt.Sprintf(f, a...))
-}
 
-func prf(pre string, f string, a ...any) {
-	fprf(os.Stdout, pre, f, a...)
-}
+	"tccgo/broker"
+	"tccgo/client"
+	"tccgo/protocol"
+)
 
-func dbg(f string, a ...any) {
-	prf("dbg", f, a...)
+// events is what the scripts process, apart from the log: JSON lines with the time
+// in microseconds ("t"), the event name ("event") and its attributes
+var events = makeEventLogger(os.Stdout)
+
+func makeEventLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			switch a.Key {
+			case slog.TimeKey:
+				return slog.Int64("t", a.Value.Time().UnixMicro())
+			case slog.LevelKey:
+				return slog.Attr{}
+			case slog.MessageKey:
+				a.Key = "event"
+			}
+			return a
+		},
+	}))
 }
 
-func pingConn(ctx context.Context, conn net.Conn) {
-	tick := time.Tick(30 * time.Second)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-tick:
-			m := msg{t: pingMsg}
-			if _, err := m.WriteTo(conn); err != nil {
-				dbg("failed to ping: %v", err)
-				return
-			}
-		}
-	}
+func event(name string, args ...any) {
+	events.Info(name, args...)
 }
 
 const (
 	bigpayload = false
 )
 
-// }
-
-type testconn struct {
-	c net.Conn
-}
-
-func (tc testconn) subscribe(topic uint16) bool {
-	c := tc.c
-	m := msg{t: subMsg, topic: topic}
-	if _, err := m.WriteTo(c); err != nil {
-		dbg("failed to subscribe: %v", err)
-		return false
-	}
-	return true
-}
-
-func (tc testconn) publish(topic uint16, payload string) bool {
-	c := tc.c
-	m := msg{t: pubMsg, topic: topic, payload: payload}
-	if _, err := m.WriteTo(c); err != nil {
-		dbg("failed to publish: %v", err)
-		return false
-	}
-	return true
-}
-
-func (tc testconn) waitPublication(topic uint16, payload string, timeout time.Duration) bool {
-	c := tc.c
-
-	d := make(chan zero)
-	time.AfterFunc(timeout, func() { close(d) })
-
-	m := msg{}
+// waitPublication waits for a publication whose payload starts with prefix
+func waitPublication(ch <-chan client.Message, prefix string, timeout time.Duration) bool {
+	d := time.After(timeout)
 	for {
 		select {
 		case <-d:
 			return false
-		default:
-		}
-		if _, err := m.ReadFrom(c); err != nil {
-			if err != io.EOF {
-				dbg("failed to read, waiting for publication: %v", err)
-			}
-			return false
-		}
-		if m.t == pubMsg && m.topic == topic && strings.Index(m.payload, payload) == 0 {
-			select {
-			case <-d:
+		case m, ok := <-ch:
+			if !ok {
 				return false
-			default:
+			}
+			if strings.Index(m.Payload, prefix) == 0 {
 				return true
 			}
 		}
 	}
 }
 
-func throughputPublisher(ctx context.Context, cancel context.CancelFunc, wg *sync.WaitGroup, conn net.Conn, topic uint16, id int) {
+func throughputPublisher(ctx context.Context, cancel context.CancelFunc, wg *sync.WaitGroup, c *client.Client, topic uint16, id int) {
 	defer func() {
-		dbg("topic=%d pub=%d terminating", topic, id)
+		slog.Debug("publisher terminating", "topic", topic, "pub", id)
 		cancel()
-		conn.Close()
+		c.Close()
 		wg.Done()
 	}()
 
-	tconn := testconn{conn}
-
-	if !tconn.subscribe(topic) {
-		dbg("publisher failed to subscribe")
+	ch, err := c.Subscribe(topic)
+	if err != nil {
+		slog.Warn("publisher failed to subscribe", "err", err)
 		return
 	}
 
@@ -136,7 +96,7 @@ func throughputPublisher(ctx context.Context, cancel context.CancelFunc, wg *syn
 		bb = new(bytes.Buffer)
 		bs = make([]byte, 2048)
 		if _, err := crand.Read(bs); err != nil {
-			dbg("topic=%d pub=%d failed to generate random bytes for big payload", topic, id)
+			slog.Error("failed to generate random bytes for big payload", "topic", topic, "pub", id)
 			return
 		}
 		for i := range bs {
@@ -159,26 +119,29 @@ func throughputPublisher(ctx context.Context, cancel context.CancelFunc, wg *syn
 			bb.WriteString(pl0)
 			pl1 = bb.String()
 		}
-		if !tconn.publish(topic, pl1) {
+		if err := c.Publish(topic, pl1); err != nil {
+			slog.Warn("failed to publish", "err", err)
 			return
 		}
-		prf("pub", "send topic=%d pub=%d", topic, id)
+		event("pub.send", "topic", topic, "pub", id)
 		sent := time.Now()
 		msgi++
 
-		if !tconn.waitPublication(topic, pl0, 1*time.Minute) {
-			dbg("publisher failed to wait for publication")
+		if !waitPublication(ch, pl0, 1*time.Minute) {
+			slog.Warn("publisher failed to wait for publication", "topic", topic, "pub", id)
 			return
 		}
 		if done() {
 			return
 		}
 		delay := time.Since(sent)
-		prf("pub", "recv topic=%d pub=%d delayMs=%d", topic, id, delay.Milliseconds())
+		event("pub.recv", "topic", topic, "pub", id, "delayMs", delay.Milliseconds())
 	}
 }
 
-func testThroughput(address string) {
+// if admin isn't empty, the server's writes per iteration are shown,
+// to compare batching settings (each write is a syscall)
+func testThroughput(address string, admin string) {
 	ctx0, cancel0 := context.WithCancel(context.Background())
 	wg0 := new(sync.WaitGroup)
 
@@ -190,68 +153,91 @@ func testThroughput(address string) {
 	)
 
 	npubconns := npubs * ntopic
-	dbg("creating %d publisher connections", npubconns)
+	slog.Info("creating publisher connections", "n", npubconns)
 	pubconns := multiconnect(nil, npubconns, 25, address)
-	dbg("created %d publisher connections", npubconns)
+	slog.Info("created publisher connections", "n", npubconns)
 	for topic := range uint16(ntopic) {
 		for pubi := range npubs {
-			conn := pubconns[int(topic)*npubs+pubi]
+			c := pubconns[int(topic)*npubs+pubi]
 			ctx, cancel := context.WithCancel(ctx0)
 
 			wg0.Add(1)
-			go throughputPublisher(ctx, cancel, wg0, conn, topic, pubi)
+			go throughputPublisher(ctx, cancel, wg0, c, topic, pubi)
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
 
-	dbg("creating %d subscriber connections", nconn)
+	slog.Info("creating subscriber connections", "n", nconn)
 	conns := multiconnect(nil, nconn, 32, address)
-	dbg("created %d subscriber connections", nconn)
-	for i, conn := range conns {
-		ctx, cancel := context.WithCancel(ctx0)
+	slog.Info("created subscriber connections", "n", nconn)
+	for i, c := range conns {
 		wg0.Add(1)
-		go io.Copy(io.Discard, conn)
 		go func() {
 			defer func() {
-				dbg("conn %d terminating", i)
-				conn.Close()
-				cancel()
+				slog.Debug("conn terminating", "conn", i)
+				c.Close()
 				wg0.Done()
 			}()
-			pingConn(ctx, conn)
+			<-ctx0.Done()
 		}()
 	}
 
+	var msgs0, writes0 int64
+	if admin != "" {
+		var err error
+		if msgs0, writes0, err = writeCounts(admin); err != nil {
+			slog.Warn("failed to get write counts", "err", err)
+			admin = ""
+		}
+	}
+
 	for it := 0; it < ntopic/subsPerIter; it++ {
-		dbg("iteration %d, topics per conn %d", it, subsPerIter*(it+1))
-		for i, conn := range conns {
-			tconn := testconn{conn}
+		slog.Info("iteration", "iteration", it, "topicsPerConn", subsPerIter*(it+1))
+		event("iteration", "iteration", it, "topicsPerConn", subsPerIter*(it+1))
+		for i, c := range conns {
 			base := subsPerIter * (it + i) % ntopic
 			for j := range subsPerIter {
 				topic := uint16(base + j)
-				tconn.subscribe(topic)
+				ch, err := c.Subscribe(topic)
+				if err != nil {
+					continue
+				}
+				go func() {
+					for range ch {
+					}
+				}()
 			}
-			dbg("conn %d subscribed to %d through %d", i, base, base+subsPerIter-1)
+			slog.Debug("conn subscribed", "conn", i, "first", base, "last", base+subsPerIter-1)
 		}
-		dbg("iteration %d finished subscribing", it)
+		slog.Info("iteration finished subscribing", "iteration", it)
 
 		time.Sleep(30 * time.Second)
+
+		if admin != "" {
+			msgs, writes, err := writeCounts(admin)
+			if err != nil {
+				slog.Warn("failed to get write counts", "err", err)
+				continue
+			}
+			dm, dw := msgs-msgs0, writes-writes0
+			event("writes", "iteration", it, "msgs", dm, "writes", dw, "msgsPerWrite", float64(dm)/float64(max(dw, 1)))
+			msgs0, writes0 = msgs, writes
+		}
 	}
 
-	dbg("finishing")
+	slog.Info("finishing")
 	cancel0()
 	wg0.Wait()
-	dbg("finished")
+	slog.Info("finished")
 }
 
-func latencyPublisher(ctx context.Context, wg *sync.WaitGroup, conn net.Conn, topic uint16, publisherIdx int, pubInterval time.Duration) {
-	go io.Copy(io.Discard, conn) // just a guarantee; unnecessary since publisher won't subscribe
+func latencyPublisher(ctx context.Context, wg *sync.WaitGroup, c *client.Client, topic uint16, publisherIdx int, pubInterval time.Duration) {
 	defer func() {
-		dbg("publisher %3d of topic %3d terminating", publisherIdx, topic)
-		conn.Close()
+		slog.Debug("publisher terminating", "publisher", publisherIdx, "topic", topic)
+		c.Close()
 		wg.Done()
 	}()
-	dbg("publisher %3d of topic %3d started", publisherIdx, topic)
+	slog.Debug("publisher started", "publisher", publisherIdx, "topic", topic)
 
 	tick := time.Tick(pubInterval)
 	publicationIdx := 0
@@ -260,44 +246,38 @@ func latencyPublisher(ctx context.Context, wg *sync.WaitGroup, conn net.Conn, to
 		case <-ctx.Done():
 			return
 		case <-tick:
-			tconn := testconn{conn}
 			payload := fmt.Sprintf("pubsher %d, pubton %d", publisherIdx, publicationIdx)
-			if !tconn.publish(topic, payload) {
+			if err := c.Publish(topic, payload); err != nil {
+				slog.Warn("failed to publish", "err", err)
 				return
 			}
-			prf("pub", "topic=%d payload=%s", topic, payload)
+			event("pub", "topic", topic, "payload", payload)
 		}
 		publicationIdx++
 	}
 }
 
-func latencySubscriber(ctx context.Context, wg *sync.WaitGroup, conn net.Conn) {
+// latencySubscriber keeps the connection until the test ends, see latencySubscribe
+func latencySubscriber(ctx context.Context, wg *sync.WaitGroup, c *client.Client) {
 	defer func() {
-		conn.Close()
+		c.Close()
 		wg.Done()
 	}()
+	<-ctx.Done()
+}
 
-	go pingConn(ctx, conn)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-
-		m := msg{}
-		if _, err := m.ReadFrom(conn); err != nil {
-			if err != io.EOF {
-				dbg("subscriber failed to read: %v", err)
-			}
-			return
-		}
-
-		if m.t == pubMsg {
-			prf("sub", "topic=%d payload=%s", m.topic, m.payload)
-		}
+// latencySubscribe subscribes, and logs the publications received until the connection is closed
+func latencySubscribe(c *client.Client, topic uint16) {
+	ch, err := c.Subscribe(topic)
+	if err != nil {
+		slog.Warn("subscriber failed to subscribe", "err", err)
+		return
 	}
+	go func() {
+		for m := range ch {
+			event("sub", "topic", m.Topic, "payload", m.Payload)
+		}
+	}()
 }
 
 func testLatency(address string) {
@@ -311,7 +291,7 @@ func testLatency(address string) {
 	wg0 := new(sync.WaitGroup)
 
 	numTotalPubConns := numTopics * numPublishersPerTopic
-	dbg("starting %d publisher connections", numTotalPubConns)
+	slog.Info("starting publisher connections", "n", numTotalPubConns)
 
 	ctx1, cancel1 := context.WithCancel(context.Background())
 
@@ -319,13 +299,13 @@ func testLatency(address string) {
 	for publisherIdx := range numPublishersPerTopic {
 		for topic := range uint16(numTopics) {
 			connIdx := int(topic)*numPublishersPerTopic + publisherIdx
-			conn := pubConns[connIdx]
-			if conn == nil {
-				dbg("skipping nil publisher")
+			c := pubConns[connIdx]
+			if c == nil {
+				slog.Warn("skipping nil publisher")
 				continue
 			}
 			wg0.Add(1)
-			go latencyPublisher(ctx1, wg0, conn, topic, publisherIdx, pubInterval)
+			go latencyPublisher(ctx1, wg0, c, topic, publisherIdx, pubInterval)
 			time.Sleep(137 * time.Millisecond)
 		}
 	}
@@ -334,36 +314,36 @@ func testLatency(address string) {
 	// so in total incNumConnSubs[-1] * numTopics connections
 	incNumConnSubs := []int{60, 120}
 
-	topicsPerConn := make(map[net.Conn][]uint16)
+	topicsPerConn := make(map[*client.Client][]uint16)
 
 	prevNumSubs := 0
 	for _, numSubs := range incNumConnSubs {
 		numNewSubs := numSubs - prevNumSubs
 		numNewConns := numNewSubs * numTopics
-		dbg("%d subs per topic, %d new connections", numSubs, numNewConns)
+		slog.Info("adding subscribers", "perTopic", numSubs, "newConns", numNewConns)
+		event("subscribers", "perTopic", numSubs, "newConns", numNewConns)
 
 		conns := multiconnect(nil, numNewConns, 30, address)
-		for _, conn := range conns {
-			if conn == nil {
-				dbg("skipping nil subscriber (0)")
+		for _, c := range conns {
+			if c == nil {
+				slog.Warn("skipping nil subscriber (0)")
 				continue
 			}
 			wg0.Add(1)
-			go latencySubscriber(ctx0, wg0, conn)
+			go latencySubscriber(ctx0, wg0, c)
 		}
 
 		connsToSubscribe := conns
 		for topic := range uint16(numTopics) {
 			for range numNewSubs {
-				var conn net.Conn
-				conn, connsToSubscribe = connsToSubscribe[0], connsToSubscribe[1:]
-				if conn == nil {
-					dbg("skipping nil subscriber (1)")
+				var c *client.Client
+				c, connsToSubscribe = connsToSubscribe[0], connsToSubscribe[1:]
+				if c == nil {
+					slog.Warn("skipping nil subscriber (1)")
 					continue
 				}
-				tconn := testconn{conn}
-				go tconn.subscribe(topic)
-				topicsPerConn[conn] = append(topicsPerConn[conn], topic)
+				go latencySubscribe(c, topic)
+				topicsPerConn[c] = append(topicsPerConn[c], topic)
 			}
 		}
 
@@ -377,35 +357,35 @@ func testLatency(address string) {
 	prevNumSubs = incNumConnSubs[len(incNumConnSubs)-1]
 	for _, numSubs := range incNumSubs {
 		numNewSubs := numSubs - prevNumSubs
-		dbg("%d subs per topic, reusing connections", numSubs)
+		slog.Info("adding subscribers, reusing connections", "perTopic", numSubs)
+		event("subscribers", "perTopic", numSubs, "newConns", 0)
 
 		for topic := range uint16(numTopics) {
 			wg := new(sync.WaitGroup)
 			for range numNewSubs {
 				// find a connection that hasn't subscribed to this topic yet
-				var conn net.Conn
+				var c *client.Client
 				found := false
-				for conn_, topics := range topicsPerConn {
+				for c_, topics := range topicsPerConn {
 					if !slices.Contains(topics, topic) {
 						found = true
-						conn = conn_
+						c = c_
 						break
 					}
 				}
 				if !found {
 					panic("no connections available")
 				}
-				if conn == nil {
-					dbg("skipping nil subscriber (2)")
+				if c == nil {
+					slog.Warn("skipping nil subscriber (2)")
 					continue
 				}
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					tconn := testconn{conn}
-					tconn.subscribe(topic)
+					latencySubscribe(c, topic)
 				}()
-				topicsPerConn[conn] = append(topicsPerConn[conn], topic)
+				topicsPerConn[c] = append(topicsPerConn[c], topic)
 			}
 			wg.Wait()
 			time.Sleep(199 * time.Millisecond)
@@ -417,15 +397,15 @@ func testLatency(address string) {
 
 	// se eu terminar o teste depois de 30 segundos, não vai dar tempo das mensagens mais demoradas
 	// serem recebidas, então a latência diminuiria! seria um viés de seleção
-	dbg("finishing publishers")
+	slog.Info("finishing publishers")
 	cancel1()
 
 	time.Sleep((180 - 30) * time.Second)
 
-	dbg("finishing latency test")
+	slog.Info("finishing latency test")
 	cancel0()
 	wg0.Done()
-	dbg("finished latency test")
+	slog.Info("finished latency test")
 }
 
 var (
@@ -449,12 +429,11 @@ func cpuLoad(topic uint16, k unique.Handle[string]) int64 {
 	return cpuSendMaps[topic][k]
 }
 
-func cpuTextPublisher(done <-chan zero, wg *sync.WaitGroup, conn net.Conn, interval time.Duration, topic uint16, publisher int) {
-	defer conn.Close()
+func cpuTextPublisher(done <-chan zero, wg *sync.WaitGroup, c *client.Client, interval time.Duration, topic uint16, publisher int) {
+	defer c.Close()
 	defer wg.Done()
-	defer dbg("publisher %2d of topic %2d terminated", publisher, topic)
+	defer slog.Debug("text publisher terminated", "publisher", publisher, "topic", topic)
 
-	tc := testconn{conn}
 	i := 0
 	tick := time.Tick(interval)
 	for {
@@ -466,20 +445,19 @@ func cpuTextPublisher(done <-chan zero, wg *sync.WaitGroup, conn net.Conn, inter
 			i++
 			sendt := time.Now().UnixMicro()
 			cpuStore(topic, unique.Make(payload), sendt)
-			if !tc.publish(topic, payload) {
+			if err := c.Publish(topic, payload); err != nil {
 				continue
 			}
 		}
 	}
 }
 
-func cpuSumPublisher(done <-chan zero, wg *sync.WaitGroup, conn net.Conn, interval time.Duration, topic uint16, publisher int) {
-	defer conn.Close()
+func cpuSumPublisher(done <-chan zero, wg *sync.WaitGroup, c *client.Client, interval time.Duration, topic uint16, publisher int) {
+	defer c.Close()
 	defer wg.Done()
-	defer dbg("publisher %2d of topic %2d terminated", publisher, topic)
+	defer slog.Debug("sum publisher terminated", "publisher", publisher, "topic", topic)
 
 	bs := []byte(nil)
-	tc := testconn{conn}
 	tick := time.Tick(interval)
 	for {
 		select {
@@ -491,7 +469,7 @@ func cpuSumPublisher(done <-chan zero, wg *sync.WaitGroup, conn net.Conn, interv
 				bs = make([]byte, sumlen)
 			}
 			if _, err := rng.Read(bs); err != nil {
-				dbg("rng failed: %v\n", err)
+				slog.Error("rng failed", "err", err)
 				continue
 			}
 			for i := range bs {
@@ -500,54 +478,44 @@ func cpuSumPublisher(done <-chan zero, wg *sync.WaitGroup, conn net.Conn, interv
 			s := string(bs)
 			payload := "!sumall " + s
 			sendt := time.Now().UnixMicro()
-			cpuStore(topic, unique.Make(sumall(s)), sendt)
-			if !tc.publish(topic, payload) {
+			cpuStore(topic, unique.Make(broker.Sumall(s)), sendt)
+			if err := c.Publish(topic, payload); err != nil {
 				continue
 			}
 		}
 	}
 }
 
-func cpuSubscriber(ctx context.Context, wg *sync.WaitGroup, conn net.Conn, topic uint16) {
-	defer conn.Close()
+func cpuSubscriber(ctx context.Context, wg *sync.WaitGroup, c *client.Client, topic uint16) {
+	defer c.Close()
 	defer wg.Done()
-	defer dbg("subscriber of topic %2d terminated", topic)
-
-	go pingConn(ctx, conn)
+	defer slog.Debug("subscriber terminated", "topic", topic)
 
-	tc := testconn{conn}
-	if !tc.subscribe(topic) {
+	ch, err := c.Subscribe(topic)
+	if err != nil {
 		return
 	}
 
 	for {
+		var m client.Message
 		select {
 		case <-ctx.Done():
 			return
-		default:
-		}
-
-		m := msg{}
-		if _, err := m.ReadFrom(conn); err != nil {
-			dbg("failed to read from topic %d", topic)
-			continue
-		}
-		if m.t != pubMsg {
-			continue
+		case m = <-ch:
 		}
 		kind := "text"
-		if m.payload[0] != '#' {
+		if m.Payload[0] != '#' {
 			kind = "sum"
 		}
-		upayload := unique.Make(m.payload)
+		upayload := unique.Make(m.Payload)
 		sendt := cpuLoad(topic, upayload)
 		if sendt == 0 {
-			dbg("did not find! %#v", upayload)
+			slog.Warn("did not find the publication", "payload", m.Payload)
 			continue
 		}
 		recvt := time.Now().UnixMicro()
 		latency := recvt - sendt
-		prf("sub", "send=%d latency=%d, kind=%s", sendt, latency, kind)
+		event("sub", "send", sendt, "latency", latency, "kind", kind)
 	}
 }
 
@@ -581,42 +549,43 @@ func testCpu(address string) {
 	ctx1, cancel1 := context.WithCancel(ctx)
 
 	conns := multiconnect(nil, numTopics*(numTextPublishers+numSumPublishers+numSubscribers), 32, address)
-	nextConn := func() net.Conn {
-		var c net.Conn
+	nextConn := func() *client.Client {
+		var c *client.Client
 		c, conns = conns[0], conns[1:]
 		return c
 	}
 
 	for publisher := range numTextPublishers {
 		for topic := range uint16(numTopics) {
-			conn := nextConn()
+			c := nextConn()
 			wg.Add(1)
-			go cpuTextPublisher(ctx1.Done(), wg, conn, textPublisherInterval, topic, publisher)
+			go cpuTextPublisher(ctx1.Done(), wg, c, textPublisherInterval, topic, publisher)
 			time.Sleep(127 * time.Millisecond)
 		}
 	}
 
 	for publisher := range numSumPublishers {
 		for topic := range uint16(numTopics) {
-			conn := nextConn()
+			c := nextConn()
 			wg.Add(1)
-			go cpuSumPublisher(ctx1.Done(), wg, conn, rotPublisherInterval, topic, publisher)
+			go cpuSumPublisher(ctx1.Done(), wg, c, rotPublisherInterval, topic, publisher)
 			time.Sleep(217 * time.Millisecond)
 		}
 	}
 
 	for topic := range uint16(numTopics) {
 		for range numSubscribers {
-			conn := nextConn()
+			c := nextConn()
 			wg.Add(1)
-			go cpuSubscriber(ctx, wg, conn, topic)
+			go cpuSubscriber(ctx, wg, c, topic)
 		}
 	}
 
 	sumlens := []int{100, 400, 700, 1000, 1300}
 
 	for _, sumlen := range sumlens {
-		dbg("sumlen=%d", sumlen)
+		slog.Info("sumlen", "sumlen", sumlen)
+		event("sumlen", "sumlen", sumlen)
 		currentsumlen.Store(int32(sumlen))
 		time.Sleep(60 * time.Second)
 	}
@@ -624,3 +593,104 @@ func testCpu(address string) {
 	cancel()
 	wg.Wait()
 }
+
+// requestResponder replies to every request on topic with its data, until the test ends
+func requestResponder(ctx context.Context, wg *sync.WaitGroup, address string, topic uint16) {
+	defer wg.Done()
+	requests := make(chan protocol.Msg, 64)
+	c, err := client.Dial(address, client.WithUnhandled(func(m protocol.Msg) {
+		if m.Type != protocol.RequestMsg {
+			return
+		}
+		select {
+		case requests <- m:
+		default:
+			slog.Warn("responder dropped a request", "topic", m.Topic)
+		}
+	}))
+	if err != nil {
+		slog.Warn("responder failed to connect", "err", err)
+		return
+	}
+	defer c.Close()
+	if _, err := c.Subscribe(topic); err != nil {
+		slog.Warn("responder failed to subscribe", "err", err)
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-requests:
+			inbox, corr, data, _ := protocol.ParseRoutedPayload(m.Payload)
+			c.Send(protocol.Msg{Type: protocol.ReplyMsg, Topic: m.Topic, Payload: protocol.RoutedPayload(inbox, corr, data)})
+		}
+	}
+}
+
+// requester makes a request every interval, logging how long each reply took
+func requester(ctx context.Context, wg *sync.WaitGroup, c *client.Client, topic uint16, id int, interval time.Duration, timeout time.Duration) {
+	defer func() {
+		c.Close()
+		wg.Done()
+	}()
+	tick := time.Tick(interval)
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		}
+		payload := fmt.Sprintf("requester %d, request %d", id, i)
+		start := time.Now()
+		data, err := c.Request(topic, payload, timeout)
+		if err == nil && data != payload {
+			err = fmt.Errorf("reply %q to %q", data, payload)
+		}
+		if err != nil {
+			event("request_failed", "topic", topic, "requester", id, "err", err.Error())
+			continue
+		}
+		event("request", "topic", topic, "requester", id, "rtt_us", time.Since(start).Microseconds())
+	}
+}
+
+func testRequest(address string) {
+	const (
+		numTopics             = 8
+		numRespondersPerTopic = 2
+		numRequestersPerTopic = 16
+		requestInterval       = 500 * time.Millisecond
+		requestTimeout        = 5 * time.Second
+		duration              = 60 * time.Second
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := new(sync.WaitGroup)
+
+	slog.Info("starting responders", "n", numTopics*numRespondersPerTopic)
+	for topic := range uint16(numTopics) {
+		for range numRespondersPerTopic {
+			wg.Add(1)
+			go requestResponder(ctx, wg, address, topic)
+		}
+	}
+	// the subscriptions have to reach the server before the first requests
+	time.Sleep(time.Second)
+
+	slog.Info("starting requesters", "n", numTopics*numRequestersPerTopic)
+	conns := multiconnect(nil, numTopics*numRequestersPerTopic, 30, address)
+	for i, c := range conns {
+		if c == nil {
+			slog.Warn("skipping nil requester")
+			continue
+		}
+		wg.Add(1)
+		go requester(ctx, wg, c, uint16(i%numTopics), i, requestInterval, requestTimeout)
+	}
+
+	time.Sleep(duration)
+	slog.Info("finishing request test")
+	cancel()
+	wg.Wait()
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
-	"net"
+	"encoding/json"
+	"log/slog"
+	"net/http"
 	"sync"
+
+	"tccgo/client"
 )
 
-func multiconnect(r []net.Conn, n int, p int, address string) []net.Conn {
+type zero = struct{}
+
+func multiconnect(r []*client.Client, n int, p int, address string) []*client.Client {
 	if r == nil {
-		r = make([]net.Conn, 0, n)
+		r = make([]*client.Client, 0, n)
 	}
 
 	work := make(chan zero)
-	ch := make(chan net.Conn)
+	ch := make(chan *client.Client)
 
 	go func() {
 		for range n {
@@ -26,11 +32,11 @@ func multiconnect(r []net.Conn, n int, p int, address string) []net.Conn {
 		go func() {
 			defer wg.Done()
 			for range work {
-				conn, err := net.Dial("tcp", address)
+				c, err := client.Dial(address)
 				if err != nil {
-					dbg("multiconnect: %v", err)
+					slog.Warn("multiconnect failed to connect", "err", err)
 				}
-				ch <- conn
+				ch <- c
 			}
 		}()
 	}
@@ -46,3 +52,23 @@ func multiconnect(r []net.Conn, n int, p int, address string) []net.Conn {
 
 	return r
 }
+
+// writeCounts reads how many messages the server sent and in how many writes from its admin API
+func writeCounts(admin string) (msgs int64, writes int64, err error) {
+	resp, err := http.Get("http://" + admin + "/stats")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	var stats struct {
+		Writes  int64            `json:"writes"`
+		MsgsOut map[string]int64 `json:"msgsOut"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return 0, 0, err
+	}
+	for _, n := range stats.MsgsOut {
+		msgs += n
+	}
+	return msgs, stats.Writes, nil
+}
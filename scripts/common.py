@@ -1,3 +1,4 @@
+import json
 import re
 import pandas as pd
 import colorsys
@@ -64,7 +65,17 @@ def parse_throughput_data(path):
     with open(path, 'r') as f:
         for line in f:
             line = line.rstrip()
-            if line.startswith('dbg'):
+            if line.startswith('{'):
+                # the harness's JSON events, see testThroughput
+                e = json.loads(line)
+                timestamp = e['t'] // 1_000_000
+                if e['event'] == 'iteration':
+                    iter_data[timestamp] = e['topicsPerConn']
+                elif e['event'] == 'pub.send':
+                    mps_data[e['topic']][e['pub']][timestamp] += 1
+                elif e['event'] == 'pub.recv':
+                    delay_data[timestamp].append(e['delayMs'])
+            elif line.startswith('dbg'):
                 pat = r"dbg: (\d+) iteration \d+, topics per conn (\d+)"
                 m = re.match(pat, line)
                 if m:
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"log"
 	"maps"
@@ -55,6 +56,34 @@ func mustParseInt(s string) int64 {
 	return i
 }
 
+// fromEvent turns an event of the harness's JSON output (see testLatency)
+// into a line of its older text output
+func fromEvent(line string) (string, bool) {
+	var e struct {
+		T        int64  `json:"t"`
+		Event    string `json:"event"`
+		Topic    uint16 `json:"topic"`
+		Payload  string `json:"payload"`
+		PerTopic int64  `json:"perTopic"`
+		NewConns int64  `json:"newConns"`
+	}
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		log.Printf("weird event: %q", line)
+		return "", false
+	}
+	switch e.Event {
+	case "pub", "sub":
+		return fmt.Sprintf("%s: %d topic=%d payload=%s", e.Event, e.T, e.Topic, e.Payload), true
+	case "subscribers":
+		conns := "reusing"
+		if e.NewConns > 0 {
+			conns = fmt.Sprintf("%d new", e.NewConns)
+		}
+		return fmt.Sprintf("dbg: %d %d subs per topic, %s connections", e.T, e.PerTopic, conns), true
+	}
+	return "", false
+}
+
 type iteration struct {
 	timestamp      int64
 	subscribers    int64
@@ -115,6 +144,13 @@ func main() {
 	scanner := bufio.NewScanner(in)
 	for scanner.Scan() {
 		line := scanner.Text()
+		if strings.HasPrefix(line, "{") {
+			l, ok := fromEvent(line)
+			if !ok {
+				continue
+			}
+			line = l
+		}
 		lineParts := reLine.FindStringSubmatch(line)
 
 		if len(lineParts) != 4 {
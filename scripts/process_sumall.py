@@ -1,3 +1,4 @@
+import json
 import re
 import sys
 import numpy as np
@@ -14,7 +15,25 @@ def parse_sumall_file(path):
     iterations = []
 
     for line in lines(path):
-        if line.startswith('sub'):
+        if line.startswith('{'):
+            # the harness's JSON events, see testCpu
+            e = json.loads(line)
+            if e['event'] == 'sub':
+                obj = {
+                    'timestamp': e['send'] // 1000 // 1000,
+                    'latency': float(e['latency']),
+                }
+                if e['kind'] == 'text':
+                    text_latencies.append(obj)
+                else:
+                    sum_latencies.append(obj)
+            elif e['event'] == 'sumlen':
+                iterations.append({
+                    'timestamp': e['t'] // 1000 // 1000,
+                    'len': e['sumlen'],
+                })
+
+        elif line.startswith('sub'):
             pat = r'sub: \d+ send=(\d+) latency=(\d+), kind=(\w+)'
             if (m := re.match(pat, line)):
                 obj = {